@@ -6,6 +6,11 @@
 
 		Once systems are setup, runs listener in a loop which spawns new
 		go routines to handle any incoming client requests.
+
+		If "udp_port" is configured, a UDP listener runs alongside the TCP
+		listener, handling each datagram in its own go routine (at most
+		maxUdpWorkers at once; datagrams beyond that are dropped). Likewise
+		"http_port" starts an HTTP server accepting POST /logs.
 */
 
 package main
@@ -14,9 +19,16 @@ import (
 	"LoggingService/config"
 	clienthandling "LoggingService/internal/client_handling"
 	"LoggingService/internal/logwriting"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"sync"
 
 	"github.com/eiannone/keyboard"
@@ -35,26 +47,85 @@ func main() {
 
 	//Init client handler
 	//Contains instances of abuse prevention and logwriter systems
-	handler := clienthandling.New(*config)
+	handler, err := clienthandling.New(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	//Test logfile paths
-	success, err := logwriting.TestLogfilePaths(config.LogfileSettings.Path, config.ErrorHandling.ErrorLogPath)
-	if !success {
-		fmt.Println(err)
+	//Test logfile paths. Those with placeholders are only known once logs arrive.
+	for _, sink := range config.AllSinkSettings() {
+		if sink.HasPathPlaceholders() {
+			continue
+		}
+		success, err := logwriting.TestLogfilePaths(sink.Path, config.ErrorHandling.ErrorLogPath)
+		if !success {
+			fmt.Println(err)
+		}
 	}
 
 	//Init listener
-	addressString := fmt.Sprintf("%s:%d", config.ServerSettings.IpAddress, config.ServerSettings.Port)
+	//IPv6 addresses are bracketed. An empty ip or "::" listens on both IPv4 & IPv6.
+	addressString := net.JoinHostPort(config.ServerSettings.IpAddress, strconv.Itoa(config.ServerSettings.Port))
 	listener, err := net.Listen("tcp", addressString)
 	if err != nil {
 		log.Fatal("Error starting TCP listener: ", err)
 	}
 	defer listener.Close()
-	fmt.Printf("TCP listener starting at %s", addressString)
+
+	//Wrap listener in TLS if a certificate is configured
+	if config.ServerSettings.TlsCertPath != "" {
+		tlsConfig, err := LoadTlsConfig(config.ServerSettings)
+		if err != nil {
+			log.Fatal("Error loading TLS configuration: ", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		fmt.Println("TLS enabled.")
+	}
+	fmt.Printf("TCP listener starting at %s\n", addressString)
 
 	//Waitgroup to wrap up all client handlers before shutdown
 	var wg sync.WaitGroup
 
+	//Init optional UDP listener
+	var udpConn net.PacketConn
+	if config.ServerSettings.UdpPort > 0 {
+		udpAddress := net.JoinHostPort(config.ServerSettings.IpAddress, strconv.Itoa(config.ServerSettings.UdpPort))
+		udpConn, err = net.ListenPacket("udp", udpAddress)
+		if err != nil {
+			log.Fatal("Error starting UDP listener: ", err)
+		}
+		defer udpConn.Close()
+		fmt.Printf("UDP listener starting at %s\n", udpAddress)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ServeUDP(udpConn, handler, &wg)
+		}()
+	}
+
+	//Init optional HTTP listener
+	var httpServer *http.Server
+	if config.ServerSettings.HttpPort > 0 {
+		httpIp := config.ServerSettings.HttpIpAddress
+		if httpIp == "" {
+			httpIp = config.ServerSettings.IpAddress
+		}
+		httpServer = handler.HttpServer(net.JoinHostPort(httpIp, strconv.Itoa(config.ServerSettings.HttpPort)))
+		httpListener, err := net.Listen("tcp", httpServer.Addr)
+		if err != nil {
+			log.Fatal("Error starting HTTP listener: ", err)
+		}
+		fmt.Printf("HTTP listener starting at %s\n", httpServer.Addr)
+
+		go func() {
+			err := httpServer.Serve(httpListener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Println("HTTP server error:", err)
+			}
+		}()
+	}
+
 	//Channel to receive shutdown signal
 	quit := make(chan error, 5)
 	//Watch for keypress to shutdown server
@@ -74,10 +145,30 @@ func main() {
 			// Stop accepting new connections
 			fmt.Println("Closing listener...")
 			listener.Close()
+			if udpConn != nil {
+				udpConn.Close()
+			}
+			if httpServer != nil {
+				// Waits for in-flight requests to complete
+				err := httpServer.Shutdown(context.Background())
+				if err != nil {
+					fmt.Println("Error shutting down HTTP server:", err)
+				}
+			}
+
+			// Unblock any persistent connections still waiting on messages
+			handler.Shutdown()
 
 			// Wait for all running client handlers to finish
 			wg.Wait()
 
+			// Flush any buffered logs to disk
+			handler.Close()
+
+			stats := handler.AbusePreventionStats()
+			fmt.Printf("Abuse prevention: %d clients tracked, %d blacklisted. %d idle clients and %d expired bans evicted.\n",
+				stats.TrackedClients, stats.Blacklisted, stats.EvictedClients, stats.ExpiredBans)
+
 			fmt.Println("Server shut down successfully.")
 			return
 
@@ -97,6 +188,81 @@ func main() {
 	}
 }
 
+// ////////////////////////////////////////////////////////////////
+// Loads the server certificate, and the client CA bundle if mutual TLS is configured
+func LoadTlsConfig(settings config.ServerSettings) (*tls.Config, error) {
+
+	certificate, err := tls.LoadX509KeyPair(settings.TlsCertPath, settings.TlsKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	//Mutual TLS: every client must present a certificate signed by one of these CAs
+	if settings.TlsClientCaPath != "" {
+		caBundle, err := os.ReadFile(settings.TlsClientCaPath)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no PEM certificates found in %q", settings.TlsClientCaPath)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// Most datagrams handled at once. A flood beyond this is dropped, as UDP would anyway, rather than piling up go routines.
+const maxUdpWorkers = 256
+
+// ////////////////////////////////////////////////////////////////
+// Reads datagrams until the UDP listener is closed, handing each to its own go routine
+func ServeUDP(conn net.PacketConn, handler *clienthandling.ClientHandler, wg *sync.WaitGroup) {
+
+	//Largest possible UDP payload
+	buffer := make([]byte, 65535)
+
+	//A slot is taken for each datagram being handled
+	workers := make(chan struct{}, maxUdpWorkers)
+
+	for {
+		bytesRead, sourceAddr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("Error reading datagram:", err)
+			continue
+		}
+
+		//All workers busy, drop it
+		select {
+		case workers <- struct{}{}:
+		default:
+			continue
+		}
+
+		//Buffer is reused for the next read, so hand off a copy
+		datagram := make([]byte, bytesRead)
+		copy(datagram, buffer[:bytesRead])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			handler.HandleDatagram(datagram, sourceAddr)
+		}()
+	}
+}
+
 // ////////////////////////////////////////////////////////////////
 // Async watch for shutdown keypress and return value via channel
 func WatchForShutdownKey(quit chan error, serverAddress string) {
@@ -3,7 +3,8 @@
 * FIRST VERSION : 	2025-02-22
 * DESCRIPTION :
 			Parses config.json, as well as the user-defined message format
-		defined in "protocol_settings": "incoming_message_schema".
+		defined in "protocol_settings": "incoming_message_schema", and any
+		per-source schemas in "source_schemas".
 
 		Calling ParseConfigFile():
 		Returns an error if config or incoming_message_schema are invalid.
@@ -13,11 +14,17 @@
 package config
 
 import (
+	"LoggingService/internal/logtemplate"
+	"LoggingService/internal/timestamps"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
+	"regexp"
+	"slices"
+	"text/template"
 
 	"github.com/xeipuuv/gojsonschema"
 )
@@ -25,6 +32,15 @@ import (
 //go:embed config_schema.json
 var configValidationSchema []byte //Embed config schema into binary to avoid user tampering in real-world scenario
 
+// Fields filled in by the server, which may be used in column_order without appearing in the incoming_message_schema
+var ServerInternalFields = []string{"timestamp", "source_ip", "client_cn", "received_time", "event_time", "clock_skew_exceeded"}
+
+// Placeholders in a logfile path, such as "logs/{source_id}/{level}.log", naming the field to fill in
+var PathPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Valid CEF extension keys
+var cefExtensionKey = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
 // Holds all three config sections from parsed config.json file
 type Config struct {
 	ServerSettings   ServerSettings   `json:"server_settings"`
@@ -35,29 +51,136 @@ type Config struct {
 
 // Where to boot up the server
 type ServerSettings struct {
-	IpAddress string `json:"ip"`
-	Port      int    `json:"port"`
+	IpAddress             string `json:"ip"`
+	Port                  int    `json:"port"`
+	PersistentConnections bool   `json:"persistent_connections"`
+	IdleTimeoutSeconds    int    `json:"idle_timeout_seconds"`
+	Framing               string `json:"framing"`
+	MaxFrameBytes         int    `json:"max_frame_bytes"`
+	UdpPort               int    `json:"udp_port"`
+	HttpIpAddress         string `json:"http_ip"`
+	HttpPort              int    `json:"http_port"`
+	TlsCertPath           string `json:"tls_cert_path"`
+	TlsKeyPath            string `json:"tls_key_path"`
+	TlsClientCaPath       string `json:"tls_client_ca_path"`
 }
 
-// Settings for logfile configuration
+// Settings for logfile configuration.
+// Also used for each entry in "sinks", which may be given in place of a single logfile.
 type LogfileSettings struct {
-	Path                    string   `json:"path"`
-	Format                  string   `json:"format"`
-	PlaintextFieldDelimiter string   `json:"plaintext_field_delimiter"`
-	PlaintextEntryDelimiter string   `json:"plaintext_entry_delimiter"`
-	ColumnOrder             []string `json:"column_order"`
-	TimestampFormat         string   `json:"timestamp_format"`
+	Path                    string             `json:"path"`
+	Format                  string             `json:"format"`
+	PlaintextFieldDelimiter string             `json:"plaintext_field_delimiter"`
+	PlaintextEntryDelimiter string             `json:"plaintext_entry_delimiter"`
+	ColumnOrder             []string           `json:"column_order"`
+	TimestampFormat         string             `json:"timestamp_format"`
+	Timezone                string             `json:"timezone"`
+	AllowDatelessTimestamp  bool               `json:"allow_dateless_timestamp"`
+	Timestamp               timestamps.Format  `json:"-"` //Resolved at startup from the 3 settings above
+	BufferSizeBytes         int                `json:"buffer_size_bytes"`
+	FlushIntervalMs         int                `json:"flush_interval_ms"`
+	Fsync                   string             `json:"fsync"`
+	FsyncIntervalMs         int                `json:"fsync_interval_ms"`
+	WriteQueueLength        int                `json:"write_queue_length"`
+	RotateMaxBytes          int64              `json:"rotate_max_bytes"`
+	RotateInterval          string             `json:"rotate_interval"`
+	RotateNaming            string             `json:"rotate_naming"`
+	MaxRotatedFiles         int                `json:"max_rotated_files"`
+	CompressRotated         bool               `json:"compress_rotated"`
+	Routes                  []RouteSettings    `json:"routes"`
+	MaxOpenFiles            int                `json:"max_open_files"`
+	Cef                     CefSettings        `json:"cef_settings"`
+	Template                string             `json:"template"`
+	TemplatePath            string             `json:"template_path"`
+	CompiledTemplate        *template.Template `json:"-"` //Parsed at startup from Template or TemplatePath
+	Sinks                   []LogfileSettings  `json:"sinks"`
+}
+
+// Sends logs whose field matches to a different path. Exactly one of equals, in & regex is set.
+type RouteSettings struct {
+	Field   string         `json:"field"`
+	Equals  interface{}    `json:"equals"`
+	In      []interface{}  `json:"in"`
+	Regex   string         `json:"regex"`
+	Path    string         `json:"path"`
+	Matcher *regexp.Regexp `json:"-"` //Compiled from Regex at startup
+}
+
+// How logs map onto Common Event Format, for the "cef" format.
+// Header slots are literal text, which may contain {field} placeholders.
+type CefSettings struct {
+	Vendor        string            `json:"vendor"`
+	Product       string            `json:"product"`
+	DeviceVersion string            `json:"device_version"`
+	SignatureId   string            `json:"signature_id"`
+	Name          string            `json:"name"`
+	Severity      string            `json:"severity"`
+	SeverityMap   map[string]string `json:"severity_map"` //Expanded severity --> CEF severity
+	Extensions    map[string]string `json:"extensions"`   //Field --> extension key, for fields in column_order
 }
 
 // Settings for Protocol & abuse prevention
 type ProtocolSettings struct {
-	IncomingMessageSchemaPath    string   `json:"incoming_json_schema"`
-	IpMessagesPerMinute          int      `json:"messages_per_ip_per_minute"`
-	BadMessageBlacklistThreshold int      `json:"bad_message_blacklist_threshold"`
-	BlacklistedIPs               []string `json:"blacklisted_ips"`
-	BlacklistPermanent           bool     `json:"blacklist_permanent"`
-	BlacklistDurationSeconds     int      `json:"blacklist_duration_seconds"`
+	IncomingMessageSchemaPath    string                  `json:"incoming_json_schema"`
+	MessageFormat                string                  `json:"message_format"`
+	AbusePreventionKey           string                  `json:"abuse_prevention_key"`
+	IpMessagesPerMinute          int                     `json:"messages_per_ip_per_minute"`
+	BadMessageBlacklistThreshold int                     `json:"bad_message_blacklist_threshold"`
+	BlacklistedIPs               []string                `json:"blacklisted_ips"`
+	BlacklistPermanent           bool                    `json:"blacklist_permanent"`
+	BlacklistDurationSeconds     int                     `json:"blacklist_duration_seconds"`
+	RateLimiter                  string                  `json:"rate_limiter"`
+	RateLimitBurst               int                     `json:"rate_limit_burst"`
+	Ipv6RateLimitPrefix          int                     `json:"ipv6_rate_limit_prefix"`
+	ClientIdleTtlSeconds         int                     `json:"client_idle_ttl_seconds"`
+	JanitorIntervalSeconds       int                     `json:"janitor_interval_seconds"`
+	StateFilePath                string                  `json:"state_file_path"`
+	StateSaveIntervalSeconds     int                     `json:"state_save_interval_seconds"`
+	AllowedNetworks              []string                `json:"allowed_networks"`
+	BlockedNetworks              []string                `json:"blocked_networks"`
+	ExemptAllowedNetworks        bool                    `json:"exempt_allowed_networks"`
+	AllowedPrefixes              []netip.Prefix          `json:"-"` //Parsed from allowed_networks at startup
+	BlockedPrefixes              []netip.Prefix          `json:"-"` //Parsed from blocked_networks at startup
+	EventTimeField               string                  `json:"event_time_field"`
+	EventTimeFormat              string                  `json:"event_time_format"`
+	EventTimeTimezone            string                  `json:"event_time_timezone"`
+	MaxClockSkewSeconds          int                     `json:"max_clock_skew_seconds"`
+	ClockSkewAction              string                  `json:"clock_skew_action"`
+	EventTime                    timestamps.Format       `json:"-"` //Resolved at startup from event_time_format & event_time_timezone
+	SourceSchemas                []SourceSchemaSettings  `json:"source_schemas"`
+	SchemaVersionField           string                  `json:"schema_version_field"`
+	CurrentSchemaVersion         int                     `json:"current_schema_version"`
+	SchemaVersions               []SchemaVersionSettings `json:"schema_versions"`
 	IncomingMessageSchema        []byte
+	IncomingMessageValidator     *gojsonschema.Schema `json:"-"` //Compiled once at startup, safe for concurrent use
+}
+
+// A schema & logfile for messages from particular sources, in place of the defaults.
+// Matches a message if its source_id is in SourceIds, or matches SourceIdPattern.
+type SourceSchemaSettings struct {
+	SourceIds                 []string             `json:"source_ids"`
+	SourceIdPattern           string               `json:"source_id_pattern"`
+	IncomingMessageSchemaPath string               `json:"incoming_json_schema"`
+	LogfileSettings           LogfileSettings      `json:"logfile_settings"`
+	Matcher                   *regexp.Regexp       `json:"-"` //Compiled from SourceIdPattern at startup
+	IncomingMessageValidator  *gojsonschema.Schema `json:"-"`
+}
+
+// An older version of the incoming_message_schema, still accepted from clients.
+// Upgrade rules bring its messages to the shape of the next newer version.
+type SchemaVersionSettings struct {
+	Version                   int                  `json:"version"`
+	IncomingMessageSchemaPath string               `json:"incoming_json_schema"`
+	Upgrade                   []UpgradeRule        `json:"upgrade"`
+	IncomingMessageValidator  *gojsonschema.Schema `json:"-"`
+}
+
+// A single change to a message: "rename" Field to To, "set_default" Field to Value if missing, or "drop" Field
+type UpgradeRule struct {
+	Action string      `json:"action"`
+	Field  string      `json:"field"`
+	To     string      `json:"to"`
+	Value  interface{} `json:"value"`
 }
 
 // Settings for error handling
@@ -104,6 +227,36 @@ func ParseConfigFile() (*Config, error) {
 		return nil, fmt.Errorf("config.json failed to validate against schema: \n%s", errorMessages)
 	}
 
+	//Resolve & check framing against the connection mode
+	err = config.ServerSettings.validateFraming()
+	if err != nil {
+		return nil, err
+	}
+
+	//Check TLS files are configured consistently
+	err = config.validateTls()
+	if err != nil {
+		return nil, err
+	}
+
+	//Parse allowed & blocked CIDR ranges
+	config.ProtocolSettings.AllowedPrefixes, err = parseNetworks(config.ProtocolSettings.AllowedNetworks, "allowed_networks")
+	if err != nil {
+		return nil, err
+	}
+	config.ProtocolSettings.BlockedPrefixes, err = parseNetworks(config.ProtocolSettings.BlockedNetworks, "blocked_networks")
+	if err != nil {
+		return nil, err
+	}
+
+	//Resolve each logfile's timestamp format & time zone
+	for _, logfile := range config.logfileSettingsRefs() {
+		err = logfile.resolveTimestamps()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//Parse incoming_message_schema.json
 	err = config.parseIncomingMessageSchema()
 	if err != nil {
@@ -113,49 +266,208 @@ func ParseConfigFile() (*Config, error) {
 	return &config, err
 }
 
-// Parse incoming_message_schema.json found in ProtocolSettings
+// Parse incoming_message_schema.json found in ProtocolSettings, and each source's schema
 func (obj *Config) parseIncomingMessageSchema() error {
 
-	data, err := os.ReadFile(obj.ProtocolSettings.IncomingMessageSchemaPath)
+	data, validator, props, err := loadIncomingMessageSchema(obj.ProtocolSettings.IncomingMessageSchemaPath, &obj.LogfileSettings)
+	if err != nil {
+		return err
+	}
+
+	//Check the client event time field & resolve its format
+	err = obj.ProtocolSettings.parseEventTime(props)
+	if err != nil {
+		return err
+	}
 
+	//Older schema versions, and the rules upgrading them to the latest (incoming_message_schema)
+	err = obj.ProtocolSettings.parseSchemaVersions(props)
 	if err != nil {
 		return err
 	}
 
+	//Each source's schema is checked against its own logfile settings
+	for i := range obj.ProtocolSettings.SourceSchemas {
+		source := &obj.ProtocolSettings.SourceSchemas[i]
+		err = source.parse()
+		if err != nil {
+			return fmt.Errorf("%w (in config.json>>protocol_settings>>source_schemas[%d])", err, i)
+		}
+	}
+
+	//Looks good, save the incoming_message_schema.
+	obj.ProtocolSettings.IncomingMessageSchema = data
+	obj.ProtocolSettings.IncomingMessageValidator = validator
+	return nil
+}
+
+// Sorts the schema versions oldest first, compiles each, and checks each upgrade rule
+// against the version it upgrades from & the version it upgrades to.
+func (obj *ProtocolSettings) parseSchemaVersions(latestProps map[string]interface{}) error {
+
+	if len(obj.SchemaVersions) == 0 {
+		return nil
+	}
+	if obj.CurrentSchemaVersion == 0 {
+		return errors.New("config.json>>protocol_settings>>current_schema_version is required with schema_versions")
+	}
+
+	slices.SortFunc(obj.SchemaVersions, func(a, b SchemaVersionSettings) int {
+		return a.Version - b.Version
+	})
+
+	//Properties of each version, then the latest
+	versionProps := make([]map[string]interface{}, len(obj.SchemaVersions)+1)
+	versionProps[len(obj.SchemaVersions)] = latestProps
+
+	for i := range obj.SchemaVersions {
+		version := &obj.SchemaVersions[i]
+		if version.Version >= obj.CurrentSchemaVersion {
+			return fmt.Errorf("config.json>>protocol_settings>>schema_versions version %d must be older than current_schema_version %d", version.Version, obj.CurrentSchemaVersion)
+		}
+		if i > 0 && version.Version == obj.SchemaVersions[i-1].Version {
+			return fmt.Errorf("config.json>>protocol_settings>>schema_versions contains version %d more than once", version.Version)
+		}
+
+		_, validator, props, err := readIncomingMessageSchema(version.IncomingMessageSchemaPath)
+		if err != nil {
+			return fmt.Errorf("%w (in config.json>>protocol_settings>>schema_versions version %d)", err, version.Version)
+		}
+		version.IncomingMessageValidator = validator
+		versionProps[i] = props
+	}
+
+	for i, version := range obj.SchemaVersions {
+		from, to := versionProps[i], versionProps[i+1]
+		for _, rule := range version.Upgrade {
+			err := validateUpgradeRule(rule, from, to)
+			if err != nil {
+				return fmt.Errorf("config.json>>protocol_settings>>schema_versions version %d upgrade rule %q on %s: %w", version.Version, rule.Action, rule.Field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Fields a rule removes must be in the older version; fields it adds must be in the newer one
+func validateUpgradeRule(rule UpgradeRule, from map[string]interface{}, to map[string]interface{}) error {
+
+	switch rule.Action {
+	case "rename":
+		if _, exists := from[rule.Field]; !exists {
+			return errors.New("field not found in this version's schema")
+		}
+		if _, exists := to[rule.To]; !exists {
+			return fmt.Errorf("%s not found in the next version's schema", rule.To)
+		}
+	case "set_default":
+		if _, exists := to[rule.Field]; !exists {
+			return errors.New("field not found in the next version's schema")
+		}
+	case "drop":
+		if _, exists := from[rule.Field]; !exists {
+			return errors.New("field not found in this version's schema")
+		}
+	}
+	return nil
+}
+
+// Compiles the source's pattern & schema, and checks its logfile settings against the schema
+func (obj *SourceSchemaSettings) parse() error {
+
+	if len(obj.SourceIds) == 0 && obj.SourceIdPattern == "" {
+		return errors.New("source_ids or source_id_pattern is required")
+	}
+
+	if obj.SourceIdPattern != "" {
+		matcher, err := regexp.Compile(obj.SourceIdPattern)
+		if err != nil {
+			return fmt.Errorf("source_id_pattern is invalid: %w", err)
+		}
+		obj.Matcher = matcher
+	}
+
+	_, validator, _, err := loadIncomingMessageSchema(obj.IncomingMessageSchemaPath, &obj.LogfileSettings)
+	if err != nil {
+		return err
+	}
+	obj.IncomingMessageValidator = validator
+	return nil
+}
+
+// Reads & compiles an incoming message schema, and validates the logfile settings used with it.
+// Returns the raw schema, the compiled schema, and its "properties".
+func loadIncomingMessageSchema(path string, logfile *LogfileSettings) ([]byte, *gojsonschema.Schema, map[string]interface{}, error) {
+
+	data, validator, props, err := readIncomingMessageSchema(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	//Ensure all columns in column_ordering are found in the properties of incoming_message_schema.json
+	for _, sink := range logfile.sinkSettingsRefs() {
+		err = validateColumnOrdering(sink.ColumnOrder, props)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = validateRoutes(*sink, props)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = validateCef(*sink, props)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = sink.parseTemplate(props)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return data, validator, props, nil
+}
+
+// Reads & compiles an incoming message schema. Returns the raw schema, the compiled schema, and its "properties".
+func readIncomingMessageSchema(path string) ([]byte, *gojsonschema.Schema, map[string]interface{}, error) {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	//Load incoming_message_schema to an object for validation.
 	var schema map[string]interface{}
 	if err := json.Unmarshal(data, &schema); err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	//Ensure "properties" object is present & populated.
 	props, ok := schema["properties"].(map[string]interface{})
 	if !ok {
-		return errors.New(`"properties" key not found in the incoming_message_schema.json file`)
+		return nil, nil, nil, fmt.Errorf(`"properties" key not found in the incoming_message_schema.json file %q`, path)
 	}
 	if len(props) == 0 {
-		return errors.New(`"properties" object in incoming_message_schema.json file cannot be empty. At minimum "source_id" is required`)
+		return nil, nil, nil, fmt.Errorf(`"properties" object in incoming_message_schema.json file %q cannot be empty. At minimum "source_id" is required`, path)
 	}
 
-	//Ensure all columns in column_ordering are found in the properties of incoming_message_schema.json
-	err = validateColumnOrdering(obj.LogfileSettings.ColumnOrder, props)
+	//Compile the schema once, rather than on every message
+	validator, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
 	if err != nil {
-		return err
+		return nil, nil, nil, fmt.Errorf("incoming_message_schema.json %q is not a valid JSON schema: %w", path, err)
 	}
 
-	//Looks good, save the incoming_message_schema.
-	obj.ProtocolSettings.IncomingMessageSchema = data
-	return nil
+	return data, validator, props, nil
 }
 
 // Ensure all columns in column_ordering (config.json) exist in the incoming_message_schema.json
-// Columns "timestamp" and "source_ip" are also allowed.
+// Server-internal fields are also allowed.
 func validateColumnOrdering(columnOrder []string, props map[string]interface{}) error {
 
 	for _, col := range columnOrder {
 
 		if _, exists := props[col]; !exists {
-			if col == "timestamp" || col == "source_ip" {
+			if slices.Contains(ServerInternalFields, col) {
 				continue
 			}
 
@@ -164,3 +476,243 @@ func validateColumnOrdering(columnOrder []string, props map[string]interface{})
 	}
 	return nil
 }
+
+// Whether a field is in the incoming_message_schema properties, or filled in by the server
+func isKnownField(props map[string]interface{}, field string) bool {
+	_, exists := props[field]
+	return exists || slices.Contains(ServerInternalFields, field)
+}
+
+// Ensure every route matches on a known field with a valid regex, and that every
+// path placeholder names a known field. Compiles each route's regex.
+func validateRoutes(sink LogfileSettings, props map[string]interface{}) error {
+
+	paths := []string{sink.Path}
+	for i := range sink.Routes {
+		route := &sink.Routes[i]
+		if !isKnownField(props, route.Field) {
+			return fmt.Errorf("config.json>>logfile_settings>>routes matches on field not found in incoming_message_schema: %s", route.Field)
+		}
+		if route.Regex != "" {
+			matcher, err := regexp.Compile(route.Regex)
+			if err != nil {
+				return fmt.Errorf("config.json>>logfile_settings>>routes contains invalid regex %q: %w", route.Regex, err)
+			}
+			route.Matcher = matcher
+		}
+		paths = append(paths, route.Path)
+	}
+
+	for _, path := range paths {
+		for _, placeholder := range PathPlaceholder.FindAllStringSubmatch(path, -1) {
+			if !isKnownField(props, placeholder[1]) {
+				return fmt.Errorf("config.json>>logfile_settings path %q contains placeholder not found in incoming_message_schema: %s", path, placeholder[1])
+			}
+		}
+	}
+	return nil
+}
+
+// CEF headers are required for the "cef" format, and may only use placeholders & extension
+// fields that are known. Extension keys may only contain letters & digits.
+func validateCef(sink LogfileSettings, props map[string]interface{}) error {
+
+	if sink.Format != "cef" {
+		return nil
+	}
+
+	cef := sink.Cef
+	if cef.Vendor == "" || cef.Product == "" || cef.Name == "" || cef.Severity == "" {
+		return errors.New("config.json>>logfile_settings>>cef_settings requires vendor, product, name & severity for the \"cef\" format")
+	}
+
+	for _, header := range []string{cef.Vendor, cef.Product, cef.DeviceVersion, cef.SignatureId, cef.Name, cef.Severity} {
+		for _, placeholder := range PathPlaceholder.FindAllStringSubmatch(header, -1) {
+			if !isKnownField(props, placeholder[1]) {
+				return fmt.Errorf("config.json>>logfile_settings>>cef_settings header %q contains placeholder not found in incoming_message_schema: %s", header, placeholder[1])
+			}
+		}
+	}
+
+	for field, key := range cef.Extensions {
+		if !isKnownField(props, field) {
+			return fmt.Errorf("config.json>>logfile_settings>>cef_settings>>extensions contains field not found in incoming_message_schema: %s", field)
+		}
+		if !cefExtensionKey.MatchString(key) {
+			return fmt.Errorf("config.json>>logfile_settings>>cef_settings>>extensions key for %s must only contain letters & digits: %q", field, key)
+		}
+	}
+	return nil
+}
+
+// For the "template" format, parses the template from "template" or "template_path".
+// Every field it references must be in the incoming_message_schema.
+func (obj *LogfileSettings) parseTemplate(props map[string]interface{}) error {
+
+	if obj.Format != "template" {
+		return nil
+	}
+
+	if (obj.Template == "") == (obj.TemplatePath == "") {
+		return errors.New(`config.json>>logfile_settings requires exactly one of template or template_path for the "template" format`)
+	}
+
+	text := obj.Template
+	if obj.TemplatePath != "" {
+		data, err := os.ReadFile(obj.TemplatePath)
+		if err != nil {
+			return fmt.Errorf("config.json>>logfile_settings>>template_path could not be read: %w", err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := logtemplate.Parse(obj.Path, text)
+	if err != nil {
+		return fmt.Errorf("config.json>>logfile_settings>>template is invalid: %w", err)
+	}
+
+	for _, field := range logtemplate.Fields(tmpl) {
+		if !isKnownField(props, field) {
+			return fmt.Errorf("config.json>>logfile_settings>>template references field not found in incoming_message_schema: %s", field)
+		}
+	}
+
+	obj.CompiledTemplate = tmpl
+	return nil
+}
+
+// The event time field must be a client field in the incoming_message_schema, in a format with a date
+func (obj *ProtocolSettings) parseEventTime(props map[string]interface{}) error {
+
+	if obj.EventTimeField == "" {
+		return nil
+	}
+
+	if _, exists := props[obj.EventTimeField]; !exists {
+		return fmt.Errorf("config.json>>protocol_settings>>event_time_field not found in incoming_message_schema: %s", obj.EventTimeField)
+	}
+
+	format, err := timestamps.New(obj.EventTimeFormat, obj.EventTimeTimezone, false)
+	if err != nil {
+		return fmt.Errorf("config.json>>protocol_settings>>event_time_format or event_time_timezone is invalid: %w", err)
+	}
+	obj.EventTime = format
+	return nil
+}
+
+// Defaults "framing" based on the connection mode, and rejects combinations that cannot work.
+// Persistent connections need a delimiter, so default to "newline"; single-message
+// connections default to "raw" for compatibility with existing clients.
+func (obj *ServerSettings) validateFraming() error {
+
+	if obj.Framing == "" {
+		if obj.PersistentConnections {
+			obj.Framing = "newline"
+		} else {
+			obj.Framing = "raw"
+		}
+	}
+
+	if obj.Framing == "raw" && obj.PersistentConnections {
+		return errors.New(`config.json>>server_settings>>framing cannot be "raw" when persistent_connections is enabled`)
+	}
+	return nil
+}
+
+// Settings for every logfile to be written: the "sinks" list if given, else the logfile_settings themselves
+func (obj LogfileSettings) SinkSettings() []LogfileSettings {
+	if len(obj.Sinks) > 0 {
+		return obj.Sinks
+	}
+	return []LogfileSettings{obj}
+}
+
+// Settings for every logfile to be written: the defaults' sinks, then each source schema's sinks
+func (obj *Config) AllSinkSettings() []LogfileSettings {
+	sinks := obj.LogfileSettings.SinkSettings()
+	for _, source := range obj.ProtocolSettings.SourceSchemas {
+		sinks = append(sinks, source.LogfileSettings.SinkSettings()...)
+	}
+	return sinks
+}
+
+// The default logfile_settings, then each source schema's
+func (obj *Config) logfileSettingsRefs() []*LogfileSettings {
+	logfiles := []*LogfileSettings{&obj.LogfileSettings}
+	for i := range obj.ProtocolSettings.SourceSchemas {
+		logfiles = append(logfiles, &obj.ProtocolSettings.SourceSchemas[i].LogfileSettings)
+	}
+	return logfiles
+}
+
+// Resolves the timestamp format & time zone of each sink
+func (obj *LogfileSettings) resolveTimestamps() error {
+
+	var err error
+	for _, sink := range obj.sinkSettingsRefs() {
+		sink.Timestamp, err = timestamps.New(sink.TimestampFormat, sink.Timezone, sink.AllowDatelessTimestamp)
+		if errors.Is(err, timestamps.ErrNoDate) {
+			return fmt.Errorf("config.json>>logfile_settings>>timestamp_format %w; set allow_dateless_timestamp to use it anyway", err)
+		}
+		if err != nil {
+			return fmt.Errorf("config.json>>logfile_settings>>timestamp_format or timezone is invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// Like SinkSettings(), but pointing at the settings so they can be filled in during validation
+func (obj *LogfileSettings) sinkSettingsRefs() []*LogfileSettings {
+	if len(obj.Sinks) == 0 {
+		return []*LogfileSettings{obj}
+	}
+	refs := make([]*LogfileSettings, len(obj.Sinks))
+	for i := range obj.Sinks {
+		refs[i] = &obj.Sinks[i]
+	}
+	return refs
+}
+
+// Whether "path" is filled in per log, e.g. "logs/{source_id}.log"
+func (obj LogfileSettings) HasPathPlaceholders() bool {
+	return PathPlaceholder.MatchString(obj.Path)
+}
+
+// Parses CIDR ranges ("10.0.0.0/8", "2001:db8::/32"). A bare IP address is a network of just that address.
+func parseNetworks(networks []string, setting string) ([]netip.Prefix, error) {
+
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return nil, fmt.Errorf("config.json>>protocol_settings>>%s: %q is not a CIDR range or IP address", setting, network)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		//IPv4-mapped IPv6 ranges are matched as IPv4
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Cert & key must be given together. Client CA (mutual TLS) and client_cn keys need TLS.
+func (obj *Config) validateTls() error {
+
+	server := obj.ServerSettings
+	if (server.TlsCertPath == "") != (server.TlsKeyPath == "") {
+		return errors.New("config.json>>server_settings>>tls_cert_path and tls_key_path must be set together")
+	}
+	if server.TlsClientCaPath != "" && server.TlsCertPath == "" {
+		return errors.New("config.json>>server_settings>>tls_client_ca_path requires tls_cert_path and tls_key_path")
+	}
+	if obj.ProtocolSettings.AbusePreventionKey == "client_cn" && server.TlsClientCaPath == "" {
+		return errors.New(`config.json>>protocol_settings>>abuse_prevention_key "client_cn" requires server_settings>>tls_client_ca_path`)
+	}
+	return nil
+}
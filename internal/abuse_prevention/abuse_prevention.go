@@ -10,49 +10,220 @@
 		- Blacklisted due to repeat offenses
 		- Is already blacklisted, and how much longer
 
+		Errors wrap ErrBlacklisted or ErrRateLimited, to be checked with errors.Is()
+
+		With "ipv6_rate_limit_prefix" set, IPv6 clients share a rate limiter with
+		the rest of their network (e.g. /64), so a host can't dodge its limit by
+		rotating through its addresses. Bans for exceeding the limit cover the
+		whole network; bans for bad messages only the address that sent them.
+
+		Rates are limited by a sliding window (default) or a token bucket,
+		selected with "rate_limiter" (see rateLimiter/).
+
+		"allowed_networks" & "blocked_networks" (CIDR ranges) are held in a prefix
+		trie, and checked by source IP before anything else. Where they overlap,
+		the more specific network wins. With "exempt_allowed_networks", clients
+		in an allowed network skip rate limiting and bad message strikes.
+
+		Every client tracked has a last seen time. EvictIdle() clears out clients
+		not seen for "client_idle_ttl_seconds" (forgetting their rate limiter and
+		bad message count), along with expired bans, so memory doesn't grow
+		with every address ever seen. It's run periodically by the ClientHandler.
+
+		With "state_file_path" set, bans and bad message counts survive restarts:
+		New() reloads them, and the ClientHandler saves them periodically and on
+		shutdown (see state.go).
+
 		Functions provided:
+		- CheckNetworkLists()
 		- CheckIpBlacklist()
 		- CheckIpRateLimiter()
 		- IncrementBadFormatCounter()
+		- EvictIdle()
+		- Stats()
 */
 
 package abuseprevention
 
 import (
 	"LoggingService/config"
+	prefixtrie "LoggingService/internal/abuse_prevention/prefixTrie"
 	ratelimiter "LoggingService/internal/abuse_prevention/rateLimiter"
+	"errors"
 	"fmt"
+	"net/netip"
 	"time"
 )
 
+// Every error returned wraps one of these, so callers can check why a client
+// was turned away with errors.Is()
+var ErrBlacklisted = errors.New("client is blacklisted")
+var ErrRateLimited = errors.New("client has exceeded its message rate limit")
+
+// Client-facing message, wrapping the reason it was sent
+type rejection struct {
+	reason  error
+	message string
+}
+
+func (r *rejection) Error() string { return r.message }
+func (r *rejection) Unwrap() error { return r.reason }
+
+func reject(reason error, format string, args ...interface{}) error {
+	return &rejection{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// What an entry in allowed_networks or blocked_networks does for the clients in it
+type networkRule int
+
+const (
+	NetworkAllowed networkRule = iota
+	NetworkBlocked
+)
+
+// Used when protocol_settings.client_idle_ttl_seconds is not set
+const defaultClientIdleTtlSeconds = 60 * 60
+
+// Rate limiter strings to be converted to int
+type rateLimiterType int
+
+const (
+	SlidingWindow rateLimiterType = iota
+	TokenBucket
+)
+
 type AbusePreventionTracker struct {
-	ipRateLimiters           map[string]*ratelimiter.RateLimiter
-	blacklistedIPs           map[string]uint32
+	ipRateLimiters           map[string]ratelimiter.Limiter
+	blacklistedIPs           map[string]ban
 	ipBadFormatCount         map[string]uint32
 	ipLimitPerMin            uint32
+	limiterType              rateLimiterType
+	burst                    uint32 //Token bucket capacity
 	blacklistDurationSeconds uint32
 	isBlacklistPermanent     bool
 	badMessageThreshold      uint32
+	ipv6PrefixLength         int //0 if IPv6 clients are rate limited per address
+	networks                 *prefixtrie.PrefixTrie[networkRule]
+	allowlistOnly            bool //Clients outside allowed_networks are turned away
+	exemptAllowed            bool
+	lastSeen                 map[string]uint32 //Unix seconds, per rate limiter & bad format count key
+	clientIdleTtlSeconds     uint32
+	evictedClients           uint64
+	expiredBans              uint64
+}
+
+// When & why a client was blacklisted
+type ban struct {
+	timestamp uint32 //Unix seconds
+	reason    string
 }
 
-func New(protocolConfig config.ProtocolSettings) *AbusePreventionTracker {
+// Why a client was banned. Saved in the state file, except for BanReasonConfigured.
+const (
+	BanReasonConfigured  = "blacklisted_ips"
+	BanReasonRateLimit   = "rate limit exceeded"
+	BanReasonBadMessages = "bad message threshold exceeded"
+)
+
+// How many clients & bans the tracker holds, and how many have been cleared out by EvictIdle()
+type Stats struct {
+	TrackedClients int
+	Blacklisted    int
+	EvictedClients uint64
+	ExpiredBans    uint64
+}
+
+func New(protocolConfig config.ProtocolSettings) (*AbusePreventionTracker, error) {
 	//Init new maps for rate limiters, blacklistedIps
 	newTracker := &AbusePreventionTracker{
-		ipRateLimiters:           make(map[string]*ratelimiter.RateLimiter),
-		blacklistedIPs:           make(map[string]uint32),
+		ipRateLimiters:           make(map[string]ratelimiter.Limiter),
+		blacklistedIPs:           make(map[string]ban),
 		ipBadFormatCount:         make(map[string]uint32),
 		ipLimitPerMin:            uint32(protocolConfig.IpMessagesPerMinute),
+		burst:                    uint32(protocolConfig.IpMessagesPerMinute),
 		isBlacklistPermanent:     protocolConfig.BlacklistPermanent,
 		blacklistDurationSeconds: uint32(protocolConfig.BlacklistDurationSeconds),
 		badMessageThreshold:      uint32(protocolConfig.BadMessageBlacklistThreshold),
+		ipv6PrefixLength:         protocolConfig.Ipv6RateLimitPrefix,
+		networks:                 prefixtrie.New[networkRule](),
+		allowlistOnly:            len(protocolConfig.AllowedPrefixes) > 0,
+		exemptAllowed:            protocolConfig.ExemptAllowedNetworks,
+		lastSeen:                 make(map[string]uint32),
+		clientIdleTtlSeconds:     defaultClientIdleTtlSeconds,
+	}
+
+	if protocolConfig.ClientIdleTtlSeconds > 0 {
+		newTracker.clientIdleTtlSeconds = uint32(protocolConfig.ClientIdleTtlSeconds)
+	}
+
+	if protocolConfig.RateLimiter == "token_bucket" {
+		newTracker.limiterType = TokenBucket
+	}
+	if protocolConfig.RateLimitBurst > 0 {
+		newTracker.burst = uint32(protocolConfig.RateLimitBurst)
+	}
+
+	//Blocked networks go in last, so they win over an identical allowed network
+	for _, network := range protocolConfig.AllowedPrefixes {
+		newTracker.networks.Insert(network, NetworkAllowed)
+	}
+	for _, network := range protocolConfig.BlockedPrefixes {
+		newTracker.networks.Insert(network, NetworkBlocked)
+	}
+
+	//Bans & bad message counts from before the last shutdown
+	if protocolConfig.StateFilePath != "" {
+		err := newTracker.loadState(protocolConfig.StateFilePath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	//Fill blacklistedIps map IP addresses & the timestamp they were banned.
+	//IPv6 addresses are written the way clients' addresses will be (lowercase, shortest form)
 	for _, ip := range protocolConfig.BlacklistedIPs {
-		newTracker.blacklistedIPs[ip] = uint32(time.Now().Unix())
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			ip = addr.Unmap().String()
+		}
+		newTracker.blacklistedIPs[ip] = ban{timestamp: uint32(time.Now().Unix()), reason: BanReasonConfigured}
 	}
 
-	return newTracker
+	return newTracker, nil
+}
+
+// Returns an error if the IP is in a blocked network, or outside every allowed network when any are configured.
+// Only reads the networks set up in New(), so unlike the other checks is safe to call without holding a lock.
+func (apt *AbusePreventionTracker) CheckNetworkLists(ipAddress string) error {
+
+	rule, found := apt.networkRule(ipAddress)
+	if found && rule == NetworkBlocked {
+		return reject(ErrBlacklisted, "IP address %s is in a blocked network", ipAddress)
+	}
+	if !found && apt.allowlistOnly {
+		return reject(ErrBlacklisted, "IP address %s is not in an allowed network", ipAddress)
+	}
+	return nil
+}
+
+// Rule of the most specific allowed/blocked network containing the client, if any.
+// Clients tracked by something other than their IP (client_cn) are in no network.
+func (apt *AbusePreventionTracker) networkRule(client string) (networkRule, bool) {
+
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return NetworkAllowed, false
+	}
+	return apt.networks.Lookup(addr)
+}
+
+// Clients in an allowed network skip rate limiting & strikes, if exempt_allowed_networks is set
+func (apt *AbusePreventionTracker) isExempt(client string) bool {
+
+	if !apt.exemptAllowed {
+		return false
+	}
+	rule, found := apt.networkRule(client)
+	return found && rule == NetworkAllowed
 }
 
 // Returns an error stating if IP is either:
@@ -60,57 +231,113 @@ func New(protocolConfig config.ProtocolSettings) *AbusePreventionTracker {
 // - Newly blacklisted due to repeat offences
 // Returns nil if no issue.
 func (apt *AbusePreventionTracker) CheckIPRateLimiter(ipAddress string) error {
+
+	if apt.isExempt(ipAddress) {
+		return nil
+	}
+
+	//IPv6 clients may share a limiter with their network
+	limiterKey := apt.rateLimiterKey(ipAddress)
+
+	//Keep both entries from being evicted as idle
+	now := uint32(time.Now().Unix())
+	apt.lastSeen[limiterKey] = now
+	apt.lastSeen[ipAddress] = now
+
 	//If IP doesn't exist in our records yet, register them
-	_, exists := apt.ipRateLimiters[ipAddress]
+	_, exists := apt.ipRateLimiters[limiterKey]
 	if !exists {
-		apt.ipRateLimiters[ipAddress] = ratelimiter.New(apt.ipLimitPerMin)
+		apt.ipRateLimiters[limiterKey] = apt.newRateLimiter()
 	}
 
 	//Check if they've exceeded their messages per min limit
-	rejected, clientOffenses := apt.ipRateLimiters[ipAddress].IsRateExceeded()
+	rejected, clientOffenses := apt.ipRateLimiters[limiterKey].IsRateExceeded()
 	if rejected {
 		//If they've exceeded the allowed threshold, ban them.
 		if clientOffenses >= apt.badMessageThreshold {
-			apt.blacklistedIPs[ipAddress] = uint32(time.Now().Unix())
+			apt.blacklistedIPs[limiterKey] = ban{timestamp: uint32(time.Now().Unix()), reason: BanReasonRateLimit}
 
 			//Reset bad format and rate limiter offence counts
-			apt.ipRateLimiters[ipAddress].ResetClientOffenses()
+			apt.ipRateLimiters[limiterKey].ResetClientOffenses()
 			apt.ipBadFormatCount[ipAddress] = 0
 
 			//If Blacklist is permanent
 			if apt.isBlacklistPermanent {
-				return fmt.Errorf("IP address %s has exceeded its message rate limit too many times and has been blacklisted", ipAddress)
+				return reject(ErrBlacklisted, "IP address %s has exceeded its message rate limit too many times and has been blacklisted", limiterKey)
 			}
 
-			return fmt.Errorf("IP address %s has exceeded its message rate limit too many times. IP address is now banned for %d seconds", ipAddress, apt.blacklistDurationSeconds)
+			return reject(ErrBlacklisted, "IP address %s has exceeded its message rate limit too many times. IP address is now banned for %d seconds", limiterKey, apt.blacklistDurationSeconds)
 		}
-		return fmt.Errorf("IP address %s has exceeded its message rate limit", ipAddress)
+		return reject(ErrRateLimited, "IP address %s has exceeded its message rate limit", limiterKey)
 	}
 	return nil
 }
 
+// A rate limiter of the configured type, for a newly seen client
+func (apt *AbusePreventionTracker) newRateLimiter() ratelimiter.Limiter {
+	if apt.limiterType == TokenBucket {
+		return ratelimiter.NewTokenBucket(apt.ipLimitPerMin, apt.burst)
+	}
+	return ratelimiter.New(apt.ipLimitPerMin)
+}
+
+// Key of the rate limiter tracking a client: the client itself, or for IPv6
+// addresses with ipv6_rate_limit_prefix set, their network (e.g. "2001:db8:1:2::/64")
+func (apt *AbusePreventionTracker) rateLimiterKey(client string) string {
+
+	if apt.ipv6PrefixLength == 0 {
+		return client
+	}
+
+	//Anything else (IPv4, client_cn keys) is tracked as-is
+	addr, err := netip.ParseAddr(client)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return client
+	}
+
+	network, err := addr.WithZone("").Prefix(apt.ipv6PrefixLength)
+	if err != nil {
+		return client
+	}
+	return network.String()
+}
+
 // Returns an error stating if IP blacklisted, and for how much longer
 // Returns nil if:
 // -IP is no longer on the blacklist
 // -IP has served their blacklist duration.
 func (apt *AbusePreventionTracker) CheckIPBlacklist(ipAddress string) error {
 
-	if timestamp, exists := apt.blacklistedIPs[ipAddress]; exists {
+	//A ban may be on the address itself, or on the network it's rate limited with
+	err := apt.checkBan(ipAddress)
+	if err != nil {
+		return err
+	}
+	if limiterKey := apt.rateLimiterKey(ipAddress); limiterKey != ipAddress {
+		return apt.checkBan(limiterKey)
+	}
+	return nil
+}
+
+// Checks a single blacklist entry, removing it if the ban has expired
+func (apt *AbusePreventionTracker) checkBan(ipAddress string) error {
+
+	if clientBan, exists := apt.blacklistedIPs[ipAddress]; exists {
 
 		//If blacklist is permanent
 		if apt.isBlacklistPermanent {
-			return fmt.Errorf("IP has been blacklisted")
+			return reject(ErrBlacklisted, "IP has been blacklisted")
 		}
 
 		//Else, check if it's time to unban them
-		durationBanned := uint32(time.Now().Unix()) - timestamp
+		durationBanned := uint32(time.Now().Unix()) - clientBan.timestamp
 		if durationBanned >= apt.blacklistDurationSeconds {
 			// They've served their time; unban them.
 			delete(apt.blacklistedIPs, ipAddress)
 		} else {
 			// If still banned; calculate the remaining time.
 			remaining := apt.blacklistDurationSeconds - durationBanned
-			return fmt.Errorf("ip is blacklisted for %v more seconds", remaining)
+			return reject(ErrBlacklisted, "ip is blacklisted for %v more seconds", remaining)
 		}
 	}
 	return nil
@@ -120,23 +347,68 @@ func (apt *AbusePreventionTracker) CheckIPBlacklist(ipAddress string) error {
 // Otherwise, increments counter and returns nil
 func (apt *AbusePreventionTracker) IncrementBadFormatCount(sourceIp string) error {
 
+	if apt.isExempt(sourceIp) {
+		return nil
+	}
+
+	apt.lastSeen[sourceIp] = uint32(time.Now().Unix())
 	apt.ipBadFormatCount[sourceIp]++
 	if apt.ipBadFormatCount[sourceIp] >= apt.badMessageThreshold {
 		//Blacklist IP
-		apt.blacklistedIPs[sourceIp] = uint32(time.Now().Unix())
+		apt.blacklistedIPs[sourceIp] = ban{timestamp: uint32(time.Now().Unix()), reason: BanReasonBadMessages}
 
 		//Reset bad format and rate limiter offence counts
-		apt.ipRateLimiters[sourceIp].ResetClientOffenses()
+		if limiter, exists := apt.ipRateLimiters[apt.rateLimiterKey(sourceIp)]; exists {
+			limiter.ResetClientOffenses()
+		}
 		apt.ipBadFormatCount[sourceIp] = 0
 
 		//If blacklist is permanent
 		if apt.isBlacklistPermanent {
-			return fmt.Errorf("IP has exceeded it's malformed message threshold and been blacklisted")
+			return reject(ErrBlacklisted, "IP has exceeded it's malformed message threshold and been blacklisted")
 		}
 
 		//If IP will be un-blacklisted in the future
-		return fmt.Errorf("source has exceeded it's bad message threshold and will be blacklisted for %d seconds", apt.blacklistDurationSeconds)
+		return reject(ErrBlacklisted, "source has exceeded it's bad message threshold and will be blacklisted for %d seconds", apt.blacklistDurationSeconds)
 	}
 
 	return nil
 }
+
+// Forgets clients not seen for client_idle_ttl_seconds, and removes expired temporary bans.
+// Caller must hold the same lock as for the other checks.
+func (apt *AbusePreventionTracker) EvictIdle(now time.Time) {
+
+	nowSeconds := uint32(now.Unix())
+
+	for key, seen := range apt.lastSeen {
+		if nowSeconds-seen < apt.clientIdleTtlSeconds {
+			continue
+		}
+		delete(apt.ipRateLimiters, key)
+		delete(apt.ipBadFormatCount, key)
+		delete(apt.lastSeen, key)
+		apt.evictedClients++
+	}
+
+	//Permanent bans are never lifted
+	if apt.isBlacklistPermanent {
+		return
+	}
+	for key, clientBan := range apt.blacklistedIPs {
+		if nowSeconds-clientBan.timestamp >= apt.blacklistDurationSeconds {
+			delete(apt.blacklistedIPs, key)
+			apt.expiredBans++
+		}
+	}
+}
+
+// Caller must hold the same lock as for the other checks.
+func (apt *AbusePreventionTracker) Stats() Stats {
+	return Stats{
+		TrackedClients: len(apt.lastSeen),
+		Blacklisted:    len(apt.blacklistedIPs),
+		EvictedClients: apt.evictedClients,
+		ExpiredBans:    apt.expiredBans,
+	}
+}
@@ -0,0 +1,93 @@
+/*
+* FILE : 			prefixtrie.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			PrefixTrie is a binary trie of CIDR ranges, for finding which of many
+		networks an IP address falls in without checking each one.
+
+		- Each bit of a network's address is a step down the trie (0 left, 1 right)
+		- A network's value is stored at the node for its last prefix bit
+		- Lookup() walks an address's bits, remembering the deepest value it
+			passes; that is the longest (most specific) matching network
+
+		IPv4 & IPv6 networks are kept in separate tries. IPv4-mapped IPv6
+		addresses are looked up as IPv4.
+*/
+
+package prefixtrie
+
+import (
+	"net/netip"
+)
+
+type PrefixTrie[V any] struct {
+	ipv4 *node[V]
+	ipv6 *node[V]
+}
+
+type node[V any] struct {
+	children [2]*node[V]
+	value    V
+	hasValue bool
+}
+
+func New[V any]() *PrefixTrie[V] {
+	return &PrefixTrie[V]{
+		ipv4: &node[V]{},
+		ipv6: &node[V]{},
+	}
+}
+
+// Stores value against the network. Inserting the same network again replaces its value.
+func (pt *PrefixTrie[V]) Insert(network netip.Prefix, value V) {
+
+	network = network.Masked()
+	addr := network.Addr()
+
+	bits := addr.AsSlice()
+	current := pt.root(addr)
+	for i := 0; i < network.Bits(); i++ {
+		bit := bitAt(bits, i)
+		if current.children[bit] == nil {
+			current.children[bit] = &node[V]{}
+		}
+		current = current.children[bit]
+	}
+
+	current.value = value
+	current.hasValue = true
+}
+
+// Returns the value of the most specific network containing addr, and whether any did
+func (pt *PrefixTrie[V]) Lookup(addr netip.Addr) (V, bool) {
+
+	var value V
+	found := false
+
+	addr = addr.Unmap().WithZone("")
+	bits := addr.AsSlice()
+	current := pt.root(addr)
+	for i := 0; current != nil; i++ {
+		if current.hasValue {
+			value, found = current.value, true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		current = current.children[bitAt(bits, i)]
+	}
+
+	return value, found
+}
+
+func (pt *PrefixTrie[V]) root(addr netip.Addr) *node[V] {
+	if addr.Is4() {
+		return pt.ipv4
+	}
+	return pt.ipv6
+}
+
+// The i'th bit of an address, counting from the most significant
+func bitAt(bits []byte, i int) int {
+	return int(bits[i/8]>>(7-i%8)) & 1
+}
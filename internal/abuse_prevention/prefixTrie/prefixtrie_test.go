@@ -0,0 +1,127 @@
+package prefixtrie
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		networks  map[string]string //Prefix --> value
+		addr      string
+		want      string
+		wantFound bool
+	}{
+		{
+			name:     "empty trie",
+			networks: map[string]string{},
+			addr:     "10.1.2.3",
+		},
+		{
+			name:      "longest prefix wins",
+			networks:  map[string]string{"10.0.0.0/8": "wide", "10.1.0.0/16": "narrow", "10.1.2.0/24": "narrowest"},
+			addr:      "10.1.2.3",
+			want:      "narrowest",
+			wantFound: true,
+		},
+		{
+			name:      "falls back to a shorter prefix",
+			networks:  map[string]string{"10.0.0.0/8": "wide", "10.1.2.0/24": "narrow"},
+			addr:      "10.1.3.1",
+			want:      "wide",
+			wantFound: true,
+		},
+		{
+			name:     "no matching prefix",
+			networks: map[string]string{"10.0.0.0/8": "wide"},
+			addr:     "192.168.0.1",
+		},
+		{
+			name:      "host route",
+			networks:  map[string]string{"10.0.0.0/8": "wide", "10.1.2.3/32": "host"},
+			addr:      "10.1.2.3",
+			want:      "host",
+			wantFound: true,
+		},
+		{
+			name:      "unmasked network is masked on insert",
+			networks:  map[string]string{"10.1.2.3/8": "wide"},
+			addr:      "10.200.0.1",
+			want:      "wide",
+			wantFound: true,
+		},
+		{
+			name:      "ipv4 /0 matches every ipv4 address",
+			networks:  map[string]string{"0.0.0.0/0": "all"},
+			addr:      "203.0.113.9",
+			want:      "all",
+			wantFound: true,
+		},
+		{
+			name:     "ipv4 /0 doesn't match ipv6",
+			networks: map[string]string{"0.0.0.0/0": "all"},
+			addr:     "2001:db8::1",
+		},
+		{
+			name:      "ipv6 /0 matches every ipv6 address",
+			networks:  map[string]string{"::/0": "all"},
+			addr:      "2001:db8::1",
+			want:      "all",
+			wantFound: true,
+		},
+		{
+			name:     "ipv6 /0 doesn't match ipv4",
+			networks: map[string]string{"::/0": "all"},
+			addr:     "10.1.2.3",
+		},
+		{
+			name:      "ipv6 longest prefix wins",
+			networks:  map[string]string{"2001:db8::/32": "wide", "2001:db8:1::/48": "narrow"},
+			addr:      "2001:db8:1::5",
+			want:      "narrow",
+			wantFound: true,
+		},
+		{
+			name:      "ipv4-mapped address is looked up as ipv4",
+			networks:  map[string]string{"10.0.0.0/8": "wide", "::/0": "ipv6"},
+			addr:      "::ffff:10.1.2.3",
+			want:      "wide",
+			wantFound: true,
+		},
+		{
+			name:      "zone is ignored",
+			networks:  map[string]string{"fe80::/10": "link-local"},
+			addr:      "fe80::1%eth0",
+			want:      "link-local",
+			wantFound: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trie := New[string]()
+			for network, value := range test.networks {
+				trie.Insert(netip.MustParsePrefix(network), value)
+			}
+
+			got, found := trie.Lookup(netip.MustParseAddr(test.addr))
+			if got != test.want || found != test.wantFound {
+				t.Errorf("Lookup(%s) = %q, %t; want %q, %t", test.addr, got, found, test.want, test.wantFound)
+			}
+		})
+	}
+}
+
+func TestInsertReplaces(t *testing.T) {
+
+	trie := New[int]()
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), 1)
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), 2)
+
+	got, found := trie.Lookup(netip.MustParseAddr("10.1.2.3"))
+	if got != 2 || !found {
+		t.Errorf("Lookup() = %d, %t; want 2, true", got, found)
+	}
+}
@@ -2,7 +2,12 @@
 * FILE : 			ratelimiter.go
 * FIRST VERSION : 	2025-02-22
 * DESCRIPTION :
-			RateLimiter is basically a simplified ring buffer that tracks
+			Limiter is implemented by each way of limiting a client's message rate,
+		selected with "rate_limiter" in config.json:
+		- RateLimiter (sliding_window): Below
+		- TokenBucket (token_bucket): See tokenbucket.go
+
+		RateLimiter is basically a simplified ring buffer that tracks
 		how many messages have been received by a source in the last minute.
 
 		- Ring buffer is allocated to size "num_messages_per_ip_per_min" from config.json
@@ -23,6 +28,16 @@ import (
 	"time"
 )
 
+type Limiter interface {
+	//Records a message. Returns true if it exceeded the rate, and the client's offense count.
+	IsRateExceeded() (bool, uint32)
+
+	IncrementClientOffenses() uint32
+
+	//Clears offenses, and lets the client send at the full rate again
+	ResetClientOffenses()
+}
+
 type RateLimiter struct {
 	timestampBuffer []uint32 //Ring buffer
 	bufferSize      uint32
@@ -0,0 +1,66 @@
+/*
+* FILE : 			tokenbucket.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			TokenBucket limits a source to an average rate, while allowing short
+		bursts above it.
+
+		- The bucket holds up to "rate_limit_burst" tokens, and starts full
+		- Tokens are added back at "messages_per_ip_per_minute" per minute
+		- Each message takes a token. With none left, the message is rejected
+		  and the offense counter is incremented
+
+		Unlike RateLimiter's ring buffer, memory used per source is the same
+		whatever the configured rate.
+*/
+
+package ratelimiter
+
+import (
+	"time"
+)
+
+type TokenBucket struct {
+	tokens         float64
+	capacity       float64
+	tokensPerNano  float64
+	lastRefill     int64 //Unix nanoseconds
+	clientOffenses uint32
+}
+
+func NewTokenBucket(msgPerMin uint32, burst uint32) *TokenBucket {
+	return &TokenBucket{
+		tokens:        float64(burst),
+		capacity:      float64(burst),
+		tokensPerNano: float64(msgPerMin) / float64(time.Minute),
+		lastRefill:    time.Now().UnixNano(),
+	}
+}
+
+func (tb *TokenBucket) IsRateExceeded() (bool, uint32) {
+
+	//Top up for the time since the last message
+	now := time.Now().UnixNano()
+	tb.tokens = min(tb.capacity, tb.tokens+float64(now-tb.lastRefill)*tb.tokensPerNano)
+	tb.lastRefill = now
+
+	//Out of tokens? Your rate has been exceeded.
+	if tb.tokens < 1 {
+		tb.clientOffenses++
+		return true, tb.clientOffenses
+	}
+
+	tb.tokens--
+	return false, tb.clientOffenses
+}
+
+func (tb *TokenBucket) IncrementClientOffenses() uint32 {
+	tb.clientOffenses++
+	return tb.clientOffenses
+}
+
+func (tb *TokenBucket) ResetClientOffenses() {
+	tb.clientOffenses = 0
+	tb.tokens = tb.capacity
+	tb.lastRefill = time.Now().UnixNano()
+}
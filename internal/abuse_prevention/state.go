@@ -0,0 +1,155 @@
+/*
+* FILE : 			state.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Saving & reloading the AbusePreventionTracker's bans and bad message
+		counts, so they survive a restart. Rate limiters are not saved; every
+		client starts the new run with a clean rate. Nor are bans from
+		"blacklisted_ips"; config.json stays the source of truth for those.
+
+		The state file is JSON, starting with a "version" header:
+		{
+			"version": 1,
+			"saved_at": 1792180800,
+			"bans": [{"client": "10.0.0.5", "banned_at": 1792180700, "reason": "rate limit exceeded"}],
+			"bad_format_counts": {"10.0.0.9": 2}
+		}
+
+		Files with a version this server doesn't know are refused, rather than
+		risk dropping bans. The file is replaced atomically, via a temporary
+		file in the same directory, so a crash mid-save can't corrupt it.
+
+		Usage:
+		- Snapshot() under the same lock as the other checks
+		- State.Save() outside of it
+		- New() reloads the file, if it exists
+*/
+
+package abuseprevention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Format of the state file. Bump when changing it, and keep loading older versions.
+const stateVersion = 1
+
+// Bans & bad message counts, as saved to the state file
+type State struct {
+	Version         int               `json:"version"`
+	SavedAt         uint32            `json:"saved_at"` //Unix seconds
+	Bans            []SavedBan        `json:"bans"`
+	BadFormatCounts map[string]uint32 `json:"bad_format_counts"`
+}
+
+type SavedBan struct {
+	Client   string `json:"client"`
+	BannedAt uint32 `json:"banned_at"` //Unix seconds
+	Reason   string `json:"reason"`
+}
+
+// Copies the bans & bad message counts. Caller must hold the same lock as for the other checks.
+func (apt *AbusePreventionTracker) Snapshot() State {
+
+	state := State{
+		Version:         stateVersion,
+		SavedAt:         uint32(time.Now().Unix()),
+		Bans:            make([]SavedBan, 0, len(apt.blacklistedIPs)),
+		BadFormatCounts: make(map[string]uint32),
+	}
+
+	//Bans from blacklisted_ips are left to config.json, so removing an IP there unbans it
+	for client, clientBan := range apt.blacklistedIPs {
+		if clientBan.reason == BanReasonConfigured {
+			continue
+		}
+		state.Bans = append(state.Bans, SavedBan{Client: client, BannedAt: clientBan.timestamp, Reason: clientBan.reason})
+	}
+	for client, count := range apt.ipBadFormatCount {
+		if count > 0 {
+			state.BadFormatCounts[client] = count
+		}
+	}
+	return state
+}
+
+// Writes the state to path, replacing any earlier state in one step
+func (state State) Save(path string) error {
+
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// Restores bans & bad message counts saved by an earlier run. A missing file is a first run, not an error.
+// Temporary bans that ran out while the server was down are dropped.
+func (apt *AbusePreventionTracker) loadState(path string) error {
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read abuse prevention state file %q: %w", path, err)
+	}
+
+	//Check the version header before trusting the rest
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("abuse prevention state file %q is not valid JSON: %w", path, err)
+	}
+	if header.Version != stateVersion {
+		return fmt.Errorf("abuse prevention state file %q has version %d; this server reads version %d", path, header.Version, stateVersion)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("abuse prevention state file %q could not be read: %w", path, err)
+	}
+
+	now := uint32(time.Now().Unix())
+	for _, saved := range state.Bans {
+		//New() re-applies blacklisted_ips from config.json
+		if saved.Reason == BanReasonConfigured {
+			continue
+		}
+		if !apt.isBlacklistPermanent && now-saved.BannedAt >= apt.blacklistDurationSeconds {
+			continue
+		}
+		apt.blacklistedIPs[saved.Client] = ban{timestamp: saved.BannedAt, reason: saved.Reason}
+	}
+
+	//Counts are kept until the client has been idle for client_idle_ttl_seconds from now
+	for client, count := range state.BadFormatCounts {
+		apt.ipBadFormatCount[client] = count
+		apt.lastSeen[client] = now
+	}
+	return nil
+}
@@ -7,6 +7,32 @@
 		Usage:
 		- clientHandling.New(*config.Config) to instantiate a client handler
 		- Use go routines to call clientHandling.HandleClient()
+		- Or clientHandling.HandleDatagram() for UDP, which sends no response
+		- Call Shutdown() before waiting on handlers, so persistent connections close
+		- Call Close() once handlers are done, to flush the logfile and save abuse prevention state
+
+		By default each connection carries a single message. With
+		"persistent_connections" enabled, clients stream messages and receive
+		one response per message. Messages are split up, and responses framed,
+		according to the "framing" mode (see internal/framing).
+
+		A JSON array is handled as a batch: each element is validated on its
+		own, all valid elements are written together, and the response carries
+		a result per element.
+
+		With "message_format" set to "syslog", messages are parsed as RFC 5424 /
+		RFC 3164 syslog (see internal/syslog) before schema validation.
+
+		With "source_schemas" configured, each message's source_id picks the
+		schema it's validated against, and the logfiles it's written to.
+		Sources that don't match any use the defaults.
+
+		With "schema_versions" configured, messages following an older version
+		of the default schema are accepted & upgraded to the current one (see
+		schema_versions.go).
+
+		If "event_time_field" is configured, the client's own event time is read
+		from it, and messages too far from the server's clock are rejected or flagged.
 
 		Mutexes will handle concurrency issues between log writing and access
 		to abuse prevention mechanisms.
@@ -17,37 +43,182 @@ package clienthandling
 import (
 	"LoggingService/config"
 	abuseprevention "LoggingService/internal/abuse_prevention"
+	"LoggingService/internal/framing"
 	"LoggingService/internal/logwriting"
+	"LoggingService/internal/syslog"
+	"LoggingService/internal/timestamps"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"strings"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
 var abusePreventionMutex sync.Mutex
 
+// Returned in place of errors that shouldn't be exposed to clients
+var errInternal = errors.New("internal server error")
+
+// Used when server_settings.max_frame_bytes is not set
+const defaultMaxFrameBytes = 64 * 1024
+
+// Used when server_settings.idle_timeout_seconds is not set
+const defaultIdleTimeout = 60 * time.Second
+
+// Used when protocol_settings.janitor_interval_seconds is not set
+const defaultJanitorInterval = 60 * time.Second
+
+// Used when protocol_settings.state_save_interval_seconds is not set
+const defaultStateSaveInterval = 60 * time.Second
+
 type ClientHandler struct {
-	schema          []byte
-	errorSettings   config.ErrorSettings
-	logWriter       *logwriting.LogWriter
-	abusePrevention *abuseprevention.AbusePreventionTracker
-	logPath         string
-	errlogPath      string
+	schema                *gojsonschema.Schema
+	errorSettings         config.ErrorSettings
+	logWriter             *logwriting.LogWriter
+	abusePrevention       *abuseprevention.AbusePreventionTracker
+	errlogPath            string
+	persistentConnections bool
+	idleTimeout           time.Duration
+	framing               framing.Mode
+	maxFrameBytes         int
+	syslogInput           bool
+	keyOnClientCN         bool
+	eventTimeField        string
+	eventTimeFormat       timestamps.Format
+	maxClockSkew          time.Duration //0 if unchecked
+	rejectClockSkew       bool          //Else flag it
+
+	//Per-source schemas & logfiles, checked in order, then the defaults
+	sources       []*messageSource
+	defaultSource *messageSource
+
+	//Older versions of the default schema, oldest first (see schema_versions.go)
+	schemaVersionField   string
+	stampSchemaVersion   bool //The current schema declares schemaVersionField
+	currentSchemaVersion int
+	schemaVersions       []*schemaVersion
+
+	//Stops the go routine evicting idle clients from abuse prevention (and saving its state)
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+	statePath   string //Empty if abuse prevention state isn't saved
+
+	//Open connections, tracked so Shutdown() can unblock them.
+	//shuttingDown is atomic so setting deadlines per message doesn't take connMutex.
+	connMutex    sync.Mutex
+	activeConns  map[net.Conn]struct{}
+	shuttingDown atomic.Bool
+}
+
+// A schema, and the logfiles for messages conforming to it
+type messageSource struct {
+	sourceIds []string
+	pattern   *regexp.Regexp
+	schema    *gojsonschema.Schema
+	logWriter *logwriting.LogWriter
+}
+
+// Body of every response sent back to a client
+type clientResponse struct {
+	Success bool         `json:"success"`
+	Message string       `json:"message"`
+	Results []itemResult `json:"results,omitempty"` //Batches only
+}
+
+// Outcome of one message within a batch
+type itemResult struct {
+	Index   int    `json:"index"`
+	Success bool   `json:"success"`
+	Message string `json:"message"`
 }
 
 // Construct new ClientHandler (compose along with new LogWriter)
-func New(settings config.Config) *ClientHandler {
-	return &ClientHandler{
-		schema:          settings.ProtocolSettings.IncomingMessageSchema,
-		errorSettings:   settings.ErrorHandling,
-		logWriter:       logwriting.New(settings.LogfileSettings),
-		abusePrevention: abuseprevention.New(settings.ProtocolSettings),
-		logPath:         settings.LogfileSettings.Path,
-		errlogPath:      settings.ErrorHandling.ErrorLogPath,
+func New(settings config.Config) (*ClientHandler, error) {
+
+	//Reloads bans from the state file, if configured
+	abusePrevention, err := abuseprevention.New(settings.ProtocolSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout := defaultIdleTimeout
+	if settings.ServerSettings.IdleTimeoutSeconds > 0 {
+		idleTimeout = time.Duration(settings.ServerSettings.IdleTimeoutSeconds) * time.Second
+	}
+
+	maxFrameBytes := defaultMaxFrameBytes
+	if settings.ServerSettings.MaxFrameBytes > 0 {
+		maxFrameBytes = settings.ServerSettings.MaxFrameBytes
+	}
+
+	schemaVersionField := defaultSchemaVersionField
+	if settings.ProtocolSettings.SchemaVersionField != "" {
+		schemaVersionField = settings.ProtocolSettings.SchemaVersionField
+	}
+
+	janitorInterval := defaultJanitorInterval
+	if settings.ProtocolSettings.JanitorIntervalSeconds > 0 {
+		janitorInterval = time.Duration(settings.ProtocolSettings.JanitorIntervalSeconds) * time.Second
+	}
+
+	stateSaveInterval := defaultStateSaveInterval
+	if settings.ProtocolSettings.StateSaveIntervalSeconds > 0 {
+		stateSaveInterval = time.Duration(settings.ProtocolSettings.StateSaveIntervalSeconds) * time.Second
+	}
+
+	//Framing is validated in config.ParseConfigFile()
+	framingMode, _ := framing.ParseMode(settings.ServerSettings.Framing)
+
+	h := &ClientHandler{
+		schema:                settings.ProtocolSettings.IncomingMessageValidator,
+		errorSettings:         settings.ErrorHandling,
+		logWriter:             logwriting.New(settings.LogfileSettings, settings.ErrorHandling.ErrorLogPath),
+		abusePrevention:       abusePrevention,
+		errlogPath:            settings.ErrorHandling.ErrorLogPath,
+		persistentConnections: settings.ServerSettings.PersistentConnections,
+		idleTimeout:           idleTimeout,
+		framing:               framingMode,
+		maxFrameBytes:         maxFrameBytes,
+		syslogInput:           settings.ProtocolSettings.MessageFormat == "syslog",
+		keyOnClientCN:         settings.ProtocolSettings.AbusePreventionKey == "client_cn",
+		eventTimeField:        settings.ProtocolSettings.EventTimeField,
+		eventTimeFormat:       settings.ProtocolSettings.EventTime,
+		maxClockSkew:          time.Duration(settings.ProtocolSettings.MaxClockSkewSeconds) * time.Second,
+		rejectClockSkew:       settings.ProtocolSettings.ClockSkewAction != "flag",
+		schemaVersionField:    schemaVersionField,
+		stampSchemaVersion:    schemaDeclares(settings.ProtocolSettings.IncomingMessageSchema, schemaVersionField),
+		currentSchemaVersion:  settings.ProtocolSettings.CurrentSchemaVersion,
+		schemaVersions:        newSchemaVersions(settings.ProtocolSettings),
+		janitorStop:           make(chan struct{}),
+		janitorDone:           make(chan struct{}),
+		statePath:             settings.ProtocolSettings.StateFilePath,
+		activeConns:           make(map[net.Conn]struct{}),
 	}
+
+	h.defaultSource = &messageSource{schema: h.schema, logWriter: h.logWriter}
+	for _, source := range settings.ProtocolSettings.SourceSchemas {
+		h.sources = append(h.sources, &messageSource{
+			sourceIds: source.SourceIds,
+			pattern:   source.Matcher,
+			schema:    source.IncomingMessageValidator,
+			logWriter: logwriting.New(source.LogfileSettings, settings.ErrorHandling.ErrorLogPath),
+		})
+	}
+
+	go h.runJanitor(janitorInterval, stateSaveInterval)
+
+	return h, nil
 }
 
 // Main go routine client handler function
@@ -55,68 +226,549 @@ func (h *ClientHandler) HandleClient(conn net.Conn) {
 
 	defer conn.Close()
 
-	//Read the message stream into memory
-	buffer := make([]byte, 4196)
-	bytesRead, err := conn.Read(buffer)
-	if bytesRead == 0 {
-		h.logWriter.WriteErrorToFile(err.Error(), "internal:HandleClient():conn.Read()", h.errlogPath)
-		h.sendResponse(conn, false, "internal server error")
+	//Register the connection so Shutdown() can unblock it
+	if !h.trackConnection(conn) {
 		return
 	}
+	defer h.untrackConnection(conn)
+
+	//Get client IP
+	clientIp := clientIpFromAddress(conn.RemoteAddr().String())
+	client := logwriting.ClientInfo{SourceIp: clientIp}
+
+	//Complete the TLS handshake up front, so the client certificate is known before the first message
+	//Deadlines are only touched if Shutdown() hasn't already cut the connection short
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if !h.setDeadline(conn.SetDeadline, time.Now().Add(h.idleTimeout)) {
+			return
+		}
+		err := tlsConn.Handshake()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				errorMessage := fmt.Sprintf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+				h.logWriter.WriteErrorToFile(errorMessage, "internal:HandleClient():tlsConn.Handshake()", h.errlogPath)
+			}
+			return
+		}
+		if !h.setDeadline(conn.SetDeadline, time.Time{}) {
+			return
+		}
+
+		client.ClientCN = clientCommonName(tlsConn.ConnectionState())
+	}
 
-	//Truncate trailing '\00' chars
-	message := buffer[:bytesRead]
+	//Single-message connections read one frame; persistent ones loop until
+	//the client disconnects, goes idle, or the server shuts down.
+	reader := framing.NewReader(conn, h.framing, h.maxFrameBytes)
+	for {
+		//Re-arming the deadline would undo Shutdown() cutting the connection short
+		if !h.setDeadline(conn.SetReadDeadline, time.Now().Add(h.idleTimeout)) {
+			return
+		}
+		message, err := reader.ReadFrame()
+		if err != nil {
+			h.handleReadError(conn, err)
+			return
+		}
+
+		//Skip blank lines & empty frames
+		if h.persistentConnections && len(bytes.TrimSpace(message)) == 0 {
+			continue
+		}
+
+		var response clientResponse
+		if batch, isBatch := h.splitBatch(message); isBatch {
+			response = batchResponse(h.handleBatch(batch, client))
+		} else {
+			err = h.handleMessage(message, client)
+			response = clientResponse{Success: err == nil, Message: responseMessage(err)}
+		}
+
+		if !h.writeResponse(conn, response) || !h.persistentConnections {
+			return
+		}
+	}
+}
+
+// Handles a single UDP datagram carrying one message.
+// Fire-and-forget: no response is sent, whatever the outcome.
+func (h *ClientHandler) HandleDatagram(datagram []byte, sourceAddr net.Addr) {
 
 	//Get client IP
-	clientAddress := strings.Split(conn.RemoteAddr().String(), ":")
+	clientIp := clientIpFromAddress(sourceAddr.String())
+
+	if len(bytes.TrimSpace(datagram)) == 0 {
+		return
+	}
+
+	client := logwriting.ClientInfo{SourceIp: clientIp}
+	if batch, isBatch := h.splitBatch(datagram); isBatch {
+		h.handleBatch(batch, client)
+		return
+	}
+	h.handleMessage(datagram, client)
+}
+
+// Responds to framing errors. EOF, idle timeout and shutdown end the connection quietly.
+func (h *ClientHandler) handleReadError(conn net.Conn, err error) {
 
-	clientIp := clientAddress[0]
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, net.ErrClosed):
+		return
+	case errors.Is(err, framing.ErrFrameTooLarge):
+		h.sendResponse(conn, false, fmt.Sprintf("message exceeds maximum frame size of %d bytes", h.maxFrameBytes))
+	case errors.Is(err, framing.ErrTruncatedFrame):
+		h.sendResponse(conn, false, "message truncated: connection closed before the full frame was received")
+	default:
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:HandleClient():ReadFrame()", h.errlogPath)
+		h.sendResponse(conn, false, errInternal.Error())
+	}
+}
+
+// Validates, formats and writes a single message.
+// Returns nil if the log was written, else an error to pass on to the client.
+func (h *ClientHandler) handleMessage(message []byte, client logwriting.ClientInfo) error {
 
-	err = h.ValidateMessage(message, clientIp)
+	source, formattedLog, err := h.prepareMessage(message, client)
 	if err != nil {
-		h.sendResponse(conn, false, err.Error())
+		return err
 	}
 
-	//Parse json into map
+	//Write log to file
+	err = source.logWriter.WriteLogToFile(formattedLog)
+	if err != nil {
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:handleMessage():WriteLogToFile()", h.errlogPath)
+		return errInternal
+	}
+
+	return nil
+}
+
+// Validates & formats each message in a batch, then writes all valid ones in a single write.
+// Returns one error per message; nil where the log was written.
+func (h *ClientHandler) handleBatch(messages [][]byte, client logwriting.ClientInfo) []error {
+
+	results := make([]error, len(messages))
+
+	//Valid logs, grouped by the source they're written for
+	var sources []*messageSource
+	formattedLogs := make(map[*messageSource][]logwriting.FormattedLog)
+	formattedIndexes := make(map[*messageSource][]int)
+
+	for i, message := range messages {
+		source, formattedLog, err := h.prepareMessage(message, client)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		if _, exists := formattedLogs[source]; !exists {
+			sources = append(sources, source)
+		}
+		formattedLogs[source] = append(formattedLogs[source], formattedLog)
+		formattedIndexes[source] = append(formattedIndexes[source], i)
+	}
+
+	//Write logs to file
+	for _, source := range sources {
+		err := source.logWriter.WriteLogsToFile(formattedLogs[source])
+		if err != nil {
+			h.logWriter.WriteErrorToFile(err.Error(), "internal:handleBatch():WriteLogsToFile()", h.errlogPath)
+			for _, i := range formattedIndexes[source] {
+				results[i] = errInternal
+			}
+		}
+	}
+
+	return results
+}
+
+// Splits a JSON array payload into its elements.
+// Returns false if the payload isn't a batch, in which case it should be handled as a single message.
+func (h *ClientHandler) splitBatch(payload []byte) ([][]byte, bool) {
+
+	trimmed := bytes.TrimSpace(payload)
+	if h.syslogInput || len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, false
+	}
+
+	//Malformed or empty arrays are left for schema validation to reject
+	var elements []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elements); err != nil || len(elements) == 0 {
+		return nil, false
+	}
+
+	messages := make([][]byte, len(elements))
+	for i, element := range elements {
+		messages[i] = element
+	}
+	return messages, true
+}
+
+// Validates, parses & formats a single message, ready to be written for the returned source.
+// Returns an error to pass on to the client if the message was rejected.
+func (h *ClientHandler) prepareMessage(message []byte, client logwriting.ClientInfo) (*messageSource, logwriting.FormattedLog, error) {
+
 	var parsedMessage map[string]interface{}
-	err = json.Unmarshal(message, &parsedMessage)
+	var err error
+	received := time.Now()
+
+	//Allowed & blocked networks always go by IP, whatever clients are otherwise tracked by
+	err = h.abusePrevention.CheckNetworkLists(client.SourceIp)
 	if err != nil {
-		h.logWriter.WriteErrorToFile(err.Error(), "internal:HandleClient():json.Unmarshal()", h.errlogPath)
-		h.sendResponse(conn, false, "internal server error")
-		return
+		return nil, nil, err
+	}
+
+	//Abuse prevention tracks clients by IP, or by certificate CN if configured
+	clientKey := h.abusePreventionKey(client)
+
+	//Syslog messages are converted to JSON, so they can be validated like any other message
+	if h.syslogInput {
+		parsedMessage, err = syslog.Parse(message)
+		if err != nil {
+			return nil, nil, h.RejectMalformedMessage(err, clientKey)
+		}
+
+		message, err = json.Marshal(parsedMessage)
+		if err != nil {
+			h.logWriter.WriteErrorToFile(err.Error(), "internal:prepareMessage():json.Marshal()", h.errlogPath)
+			return nil, nil, errInternal
+		}
+	}
+
+	//Pick the schema & logfiles for the message's source_id
+	source := h.sourceFor(message)
+	schema := source.schema
+
+	//Older versions of the default schema are validated as sent, then upgraded below
+	var version *schemaVersion
+	if source == h.defaultSource && len(h.schemaVersions) > 0 {
+		version, err = h.messageVersion(message)
+		if err != nil {
+			return nil, nil, h.RejectMalformedMessage(err, clientKey)
+		}
+		if version != nil {
+			schema = version.schema
+		}
+	}
+
+	err = h.ValidateMessage(message, schema, clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Parse json into map
+	if parsedMessage == nil {
+		err = json.Unmarshal(message, &parsedMessage)
+		if err != nil {
+			h.logWriter.WriteErrorToFile(err.Error(), "internal:prepareMessage():json.Unmarshal()", h.errlogPath)
+			return nil, nil, errInternal
+		}
+	}
+
+	//Bring older messages up to the current schema
+	if version != nil {
+		err = h.upgradeMessage(parsedMessage, version)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//Work out when it happened
+	times, err := h.logTimes(parsedMessage, received, clientKey)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	//Format log
-	formattedLog, err := h.logWriter.FormatLogEntry(parsedMessage, clientIp)
+	formattedLog, err := source.logWriter.FormatLogEntry(parsedMessage, client, times)
 	if err != nil {
-		h.logWriter.WriteErrorToFile(err.Error(), "internal: internal:HandleClient():FormatLogEntry()", h.errlogPath)
-		h.sendResponse(conn, false, "internal server error")
-		return
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:prepareMessage():FormatLogEntry()", h.errlogPath)
+		return nil, nil, errInternal
 	}
 
-	//Write log to file
-	err = h.logWriter.WriteLogToFile(formattedLog, h.logPath)
+	return source, formattedLog, nil
+}
+
+// The first source whose source_ids or source_id_pattern matches the message's source_id, else the defaults.
+// Messages without a string source_id use the defaults, whose schema decides if that's allowed.
+func (h *ClientHandler) sourceFor(message []byte) *messageSource {
+
+	if len(h.sources) == 0 {
+		return h.defaultSource
+	}
+
+	var peek struct {
+		SourceId interface{} `json:"source_id"`
+	}
+	if err := json.Unmarshal(message, &peek); err != nil {
+		return h.defaultSource
+	}
+	sourceId, ok := peek.SourceId.(string)
+	if !ok {
+		return h.defaultSource
+	}
+
+	for _, source := range h.sources {
+		if slices.Contains(source.sourceIds, sourceId) || (source.pattern != nil && source.pattern.MatchString(sourceId)) {
+			return source
+		}
+	}
+	return h.defaultSource
+}
+
+// Takes the event time from the client's event_time_field, if configured & present, and checks its clock skew.
+// An unreadable time counts as a bad message; too much skew rejects the message without a strike.
+func (h *ClientHandler) logTimes(log map[string]interface{}, received time.Time, clientKey string) (logwriting.LogTimes, error) {
+
+	times := logwriting.LogTimes{Received: received, Event: received}
+	if h.eventTimeField == "" {
+		return times, nil
+	}
+
+	value, exists := log[h.eventTimeField]
+	if !exists {
+		return times, nil
+	}
+
+	eventTime, err := h.eventTimeFormat.Parse(value)
+	if err != nil {
+		abusePreventionMutex.Lock()
+		defer abusePreventionMutex.Unlock()
+		return times, h.recordBadMessage(fmt.Errorf("%s could not be read as a time: %w", h.eventTimeField, err), clientKey)
+	}
+	times.Event = eventTime
+
+	skew := received.Sub(eventTime).Abs()
+	if h.maxClockSkew == 0 || skew <= h.maxClockSkew {
+		return times, nil
+	}
+
+	if !h.rejectClockSkew {
+		times.SkewExceeded = true
+		return times, nil
+	}
+
+	skewErr := fmt.Errorf("%s is %s from server time, more than the %s allowed", h.eventTimeField, skew.Round(time.Second), h.maxClockSkew)
+	if h.errorSettings.InvalidMessage == "redirect_to_error_log" {
+		h.logWriter.WriteErrorToFile(skewErr.Error(), "clock skew", h.errlogPath)
+	}
+	return times, skewErr
+}
+
+// Host part of a "host:port" address (IPv6 hosts are bracketed). IPv4 clients of a
+// dual-stack listener can appear as IPv4-mapped IPv6 addresses; these are given as plain IPv4.
+func clientIpFromAddress(address string) string {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
+
+// Key used to track the client in abuse prevention: the certificate CN if
+// configured & presented, else the source IP.
+func (h *ClientHandler) abusePreventionKey(client logwriting.ClientInfo) string {
+	if h.keyOnClientCN && client.ClientCN != "" {
+		return client.ClientCN
+	}
+	return client.SourceIp
+}
+
+// Subject CN of the verified client certificate, or "" if none was presented
+func clientCommonName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// Message sent back to the client for the result of handleMessage()
+func responseMessage(err error) string {
 	if err != nil {
-		h.logWriter.WriteErrorToFile(err.Error(), "internal:HandleClient():WriteLogToFile()", h.errlogPath)
-		h.sendResponse(conn, false, "internal server error")
+		return err.Error()
+	}
+	return "log received"
+}
+
+// Response for the result of handleBatch(), with one result per message.
+// Only successful if every message was written.
+func batchResponse(results []error) clientResponse {
+
+	itemResults := make([]itemResult, len(results))
+	received := 0
+	for i, err := range results {
+		itemResults[i] = itemResult{Index: i, Success: err == nil, Message: responseMessage(err)}
+		if err == nil {
+			received++
+		}
+	}
+
+	return clientResponse{
+		Success: received == len(results),
+		Message: fmt.Sprintf("%d of %d logs received", received, len(results)),
+		Results: itemResults,
+	}
+}
+
+// Flushes & closes the logfile. Call once all handlers have returned.
+func (h *ClientHandler) Close() {
+	close(h.janitorStop)
+	<-h.janitorDone
+	h.saveAbusePreventionState()
+
+	h.logWriter.Close()
+	for _, source := range h.sources {
+		source.logWriter.Close()
+	}
+}
+
+// Periodically clears idle clients & expired bans out of abuse prevention,
+// and saves its state if configured, until Close()
+func (h *ClientHandler) runJanitor(interval time.Duration, saveInterval time.Duration) {
+
+	defer close(h.janitorDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	//Never fires if state isn't saved
+	var saveTick <-chan time.Time
+	if h.statePath != "" {
+		saveTicker := time.NewTicker(saveInterval)
+		defer saveTicker.Stop()
+		saveTick = saveTicker.C
+	}
+
+	for {
+		select {
+		case <-h.janitorStop:
+			return
+		case now := <-ticker.C:
+			abusePreventionMutex.Lock()
+			h.abusePrevention.EvictIdle(now)
+			abusePreventionMutex.Unlock()
+		case <-saveTick:
+			h.saveAbusePreventionState()
+		}
+	}
+}
+
+// Writes bans & bad message counts to the state file, if configured.
+// Copied under the lock, but written outside it, so clients aren't held up by disk I/O.
+func (h *ClientHandler) saveAbusePreventionState() {
+
+	if h.statePath == "" {
 		return
 	}
 
-	//Send "Success" response to client
-	response := []byte(`{"success": true, "message": "log received"}`)
+	abusePreventionMutex.Lock()
+	state := h.abusePrevention.Snapshot()
+	abusePreventionMutex.Unlock()
 
-	bytesWritten, err := conn.Write(response)
-	if bytesWritten == 0 || err != nil {
-		errorMessage := fmt.Sprintf("Unable to respond to client on connection: %s", conn.RemoteAddr())
-		h.logWriter.WriteErrorToFile(errorMessage, "internal:sendResponse():conn.Write()", h.errlogPath)
+	err := state.Save(h.statePath)
+	if err != nil {
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:saveAbusePreventionState():State.Save()", h.errlogPath)
+	}
+}
+
+// Counts of clients & bans held by abuse prevention, and how many have been evicted
+func (h *ClientHandler) AbusePreventionStats() abuseprevention.Stats {
+	abusePreventionMutex.Lock()
+	defer abusePreventionMutex.Unlock()
+	return h.abusePrevention.Stats()
+}
+
+// Unblocks all open connections so their handlers can return, whether reading or writing.
+// Connections accepted after this point are closed immediately.
+func (h *ClientHandler) Shutdown() {
+	h.connMutex.Lock()
+	defer h.connMutex.Unlock()
+
+	h.shuttingDown.Store(true)
+	for conn := range h.activeConns {
+		conn.SetDeadline(time.Now())
 	}
 }
 
+// Sets one of the connection's deadlines, unless the server is shutting down.
+// Returns false if the server is shutting down.
+func (h *ClientHandler) setDeadline(set func(time.Time) error, deadline time.Time) bool {
+
+	if h.shuttingDown.Load() {
+		return false
+	}
+	set(deadline)
+
+	//Shutdown() may have set its deadline in the meantime, only for this one to replace it.
+	//It flags shuttingDown before setting deadlines, so checking again catches that.
+	if h.shuttingDown.Load() {
+		set(time.Now())
+		return false
+	}
+	return true
+}
+
+// Returns false if the server is already shutting down
+func (h *ClientHandler) trackConnection(conn net.Conn) bool {
+	h.connMutex.Lock()
+	defer h.connMutex.Unlock()
+
+	if h.shuttingDown.Load() {
+		return false
+	}
+	h.activeConns[conn] = struct{}{}
+	return true
+}
+
+func (h *ClientHandler) untrackConnection(conn net.Conn) {
+	h.connMutex.Lock()
+	defer h.connMutex.Unlock()
+
+	delete(h.activeConns, conn)
+}
+
 // Runs all abuse prevention stuff & validates client message against schema
-func (h *ClientHandler) ValidateMessage(data []byte, clientIp string) error {
+func (h *ClientHandler) ValidateMessage(data []byte, schema *gojsonschema.Schema, clientIp string) error {
+
+	abusePreventionMutex.Lock()
+	err := h.checkClientStanding(clientIp)
+	abusePreventionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	//Check message against json schema
+	//Done outside the lock, so clients don't queue up behind each other's validation
+	formatErr := h.CompareAgainstSchema(data, schema)
+	if formatErr == nil {
+		return nil
+	}
 
 	abusePreventionMutex.Lock()
 	defer abusePreventionMutex.Unlock()
+	return h.recordBadMessage(formatErr, clientIp)
+}
+
+// Same abuse prevention as ValidateMessage(), for messages that could not be parsed at all.
+// Always returns an error: the parse error, or why the client is being turned away.
+func (h *ClientHandler) RejectMalformedMessage(parseErr error, clientIp string) error {
+
+	abusePreventionMutex.Lock()
+	defer abusePreventionMutex.Unlock()
+
+	err := h.checkClientStanding(clientIp)
+	if err != nil {
+		return err
+	}
+	return h.recordBadMessage(parseErr, clientIp)
+}
+
+// Checks blacklist & rate limit. Caller must hold abusePreventionMutex.
+func (h *ClientHandler) checkClientStanding(clientIp string) error {
 
 	//Check if IP is banned
 	result := h.abusePrevention.CheckIPBlacklist(clientIp)
@@ -125,36 +777,31 @@ func (h *ClientHandler) ValidateMessage(data []byte, clientIp string) error {
 	}
 
 	//Log message in rate limiter, check if rate has been exceeded.
-	err := h.abusePrevention.CheckIPRateLimiter(clientIp)
-	if err != nil {
-		return err
+	return h.abusePrevention.CheckIPRateLimiter(clientIp)
+}
+
+// Adds a strike against the client for a bad message. Caller must hold abusePreventionMutex.
+// Returns a ban notice if the client is now banned, else the formatting error itself.
+func (h *ClientHandler) recordBadMessage(formatErr error, clientIp string) error {
+
+	//Are they banned now? If so let them know.
+	banMessage := h.abusePrevention.IncrementBadFormatCount(clientIp)
+	if banMessage != nil {
+		return banMessage
 	}
 
-	//Check message against json schema
-	err = h.CompareAgainstSchema(data, h.schema)
-	if err != nil {
-		//Are they banned now? If so let them know.
-		banMessage := h.abusePrevention.IncrementBadFormatCount(clientIp)
-		if banMessage != nil {
-			return banMessage
-		} else { //Else, just send back the formatting errors
-			//Log it as well, if that's what config says
-			if h.errorSettings.InvalidMessage == "redirect_to_error_log" {
-				h.logWriter.WriteErrorToFile(err.Error(), "invalid message format", h.errlogPath)
-			}
-			return err
-		}
+	//Else, just send back the formatting errors
+	//Log it as well, if that's what config says
+	if h.errorSettings.InvalidMessage == "redirect_to_error_log" {
+		h.logWriter.WriteErrorToFile(formatErr.Error(), "invalid message format", h.errlogPath)
 	}
-	return nil
+	return formatErr
 }
 
-// Validate the incoming message against the json schema referenced in config.json
-func (handler *ClientHandler) CompareAgainstSchema(data []byte, schema []byte) error {
-
-	schemaLoader := gojsonschema.NewStringLoader(string(schema))
-	dataLoader := gojsonschema.NewStringLoader(string(data))
+// Validate the incoming message against the compiled json schema referenced in config.json
+func (handler *ClientHandler) CompareAgainstSchema(data []byte, schema *gojsonschema.Schema) error {
 
-	result, err := gojsonschema.Validate(schemaLoader, dataLoader)
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
 
 	if err != nil {
 		return err
@@ -170,14 +817,24 @@ func (handler *ClientHandler) CompareAgainstSchema(data []byte, schema []byte) e
 	return nil
 }
 
-func (handler *ClientHandler) sendResponse(conn net.Conn, success bool, message string) {
+func (handler *ClientHandler) sendResponse(conn net.Conn, success bool, message string) bool {
+	return handler.writeResponse(conn, clientResponse{Success: success, Message: message})
+}
+
+func (handler *ClientHandler) writeResponse(conn net.Conn, body clientResponse) bool {
 
-	response := fmt.Sprintf("{\"success\": %v, \"message\": \"%s\"}", success, message)
+	response, _ := json.Marshal(body)
 
-	bytesWritten, err := conn.Write([]byte(response))
+	//A client that stops reading would otherwise block the write forever, and with it Shutdown()
+	if !handler.setDeadline(conn.SetWriteDeadline, time.Now().Add(handler.idleTimeout)) {
+		return false
+	}
+	bytesWritten, err := conn.Write(framing.Encode(handler.framing, response))
 
 	if bytesWritten == 0 || err != nil {
 		errorMessage := fmt.Sprintf("Unable to respond to client on connection: %s", conn.RemoteAddr())
-		handler.logWriter.WriteErrorToFile(errorMessage, "internal:sendResponse():conn.Write()", handler.errlogPath)
+		handler.logWriter.WriteErrorToFile(errorMessage, "internal:writeResponse():conn.Write()", handler.errlogPath)
+		return false
 	}
+	return true
 }
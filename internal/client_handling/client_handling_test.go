@@ -0,0 +1,281 @@
+package clienthandling
+
+import (
+	"LoggingService/config"
+	"LoggingService/internal/timestamps"
+	"bufio"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"source_id": {"type": "string", "minLength": 1},
+		"level": {"type": "string", "enum": ["INFO", "ERROR", "WARN"]},
+		"message": {"type": "string", "maxLength": 1024}
+	},
+	"required": ["source_id", "level", "message"]
+}`
+
+const testMessage = `{"source_id":"bench","level":"INFO","message":"hello"}`
+
+// Settings for a handler writing ndjson to a temporary directory, with persistent
+// newline-framed connections and limits high enough not to get in the way
+func testConfig(tb testing.TB) config.Config {
+
+	validator, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(testSchema))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	timestamp, err := timestamps.New("", "", false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	dir := tb.TempDir()
+	return config.Config{
+		ServerSettings: config.ServerSettings{
+			PersistentConnections: true,
+			Framing:               "newline",
+			IdleTimeoutSeconds:    5,
+		},
+		LogfileSettings: config.LogfileSettings{
+			Path:        filepath.Join(dir, "logs.ndjson"),
+			Format:      "ndjson",
+			ColumnOrder: []string{"timestamp", "source_ip", "level", "message"},
+			Timestamp:   timestamp,
+		},
+		ProtocolSettings: config.ProtocolSettings{
+			IpMessagesPerMinute:          1 << 20,
+			BadMessageBlacklistThreshold: 1 << 20,
+			BlacklistDurationSeconds:     1,
+			IncomingMessageSchema:        []byte(testSchema),
+			IncomingMessageValidator:     validator,
+		},
+		ErrorHandling: config.ErrorSettings{
+			InvalidMessage: "ignore",
+			ErrorLogPath:   filepath.Join(dir, "errors.txt"),
+		},
+	}
+}
+
+func newTestHandler(tb testing.TB) *ClientHandler {
+	h, err := New(testConfig(tb))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(h.Close)
+	return h
+}
+
+// A client streaming without pause keeps the handler busy, so Shutdown() mostly lands
+// between reads. The handler must still return, rather than re-arming its read deadline.
+func TestShutdownStopsStreamingClient(t *testing.T) {
+
+	h := newTestHandler(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		h.HandleClient(conn)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	//Stream messages & drain responses until the server hangs up
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		line := []byte(testMessage + "\n")
+		for {
+			if _, err := client.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		reader := bufio.NewReader(client)
+		for {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				return
+			}
+		}
+	}()
+
+	//Let the stream get going, so the handler is mid-message when Shutdown() arrives
+	time.Sleep(200 * time.Millisecond)
+	h.Shutdown()
+
+	select {
+	case <-handlerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleClient still running 2s after Shutdown()")
+	}
+
+	client.Close()
+	wg.Wait()
+}
+
+// A client that streams but never reads fills its receive buffer, leaving the handler
+// blocked writing a response. Shutdown() must cut that write short too.
+func TestShutdownStopsClientNotReading(t *testing.T) {
+
+	h := newTestHandler(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		//Small buffers fill quickly
+		conn.(*net.TCPConn).SetWriteBuffer(4096)
+		h.HandleClient(conn)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.(*net.TCPConn).SetReadBuffer(4096)
+
+	//Stream messages without ever reading a response, until the server hangs up
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		line := []byte(testMessage + "\n")
+		for {
+			if _, err := client.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+
+	//Give the unread responses time to fill the buffers, so the handler is stuck writing
+	time.Sleep(500 * time.Millisecond)
+	h.Shutdown()
+
+	select {
+	case <-handlerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleClient still running 2s after Shutdown()")
+	}
+
+	client.Close()
+	<-writerDone
+}
+
+// Validation as it was before the schema was compiled once: recompiled from its source for every message
+func compareAgainstSchemaSource(data []byte, schema []byte) error {
+	_, err := gojsonschema.Validate(gojsonschema.NewStringLoader(string(schema)), gojsonschema.NewStringLoader(string(data)))
+	return err
+}
+
+// ValidateMessage() as it was before: recompiling the schema, all while holding abusePreventionMutex
+func (h *ClientHandler) validateMessageLocked(data []byte, schema []byte, clientIp string) error {
+
+	abusePreventionMutex.Lock()
+	defer abusePreventionMutex.Unlock()
+
+	err := h.checkClientStanding(clientIp)
+	if err != nil {
+		return err
+	}
+	return compareAgainstSchemaSource(data, schema)
+}
+
+func BenchmarkCompareAgainstSchema(b *testing.B) {
+
+	h := newTestHandler(b)
+	data := []byte(testMessage)
+	source := []byte(testSchema)
+
+	b.Run("recompiled", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := compareAgainstSchemaSource(data, source); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("compiled", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := h.CompareAgainstSchema(data, h.schema); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
+// Each parallel goroutine is its own client, so only the shared lock ties them together
+func BenchmarkValidateMessage(b *testing.B) {
+
+	h := newTestHandler(b)
+	data := []byte(testMessage)
+	source := []byte(testSchema)
+
+	var clients sync.Mutex
+	nextClient := 0
+	clientIp := func() string {
+		clients.Lock()
+		defer clients.Unlock()
+		nextClient++
+		return net.IPv4(10, 0, byte(nextClient>>8), byte(nextClient)).String()
+	}
+
+	b.Run("locked_recompiled", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			ip := clientIp()
+			for pb.Next() {
+				if err := h.validateMessageLocked(data, source, ip); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("unlocked_compiled", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			ip := clientIp()
+			for pb.Next() {
+				if err := h.ValidateMessage(data, h.schema, ip); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,146 @@
+/*
+* FILE : 			http_handling.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			HTTP front end for the ClientHandler, for clients that cannot open
+		raw sockets (browsers, serverless functions, etc).
+
+		POST /logs accepts either a single JSON message, or a JSON array of
+		messages (a batch). Each message goes through the same validation, abuse
+		prevention and log writing as messages received over TCP.
+
+		Responds with the same body as TCP clients receive, with the status
+		code reflecting the outcome:
+		- 200: Logged (every message, for batches)
+		- 207: Batch partially logged; see the per-message results
+		- 400: Message failed to parse or validate against the schema
+		- 403: Client is blacklisted
+		- 429: Client has exceeded its rate limit
+		- 500: Internal server error
+
+		Clients taking longer than "idle_timeout_seconds" to send a request, or
+		leaving a keep-alive connection idle for longer, are disconnected.
+*/
+
+package clienthandling
+
+import (
+	abuseprevention "LoggingService/internal/abuse_prevention"
+	"LoggingService/internal/logwriting"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Largest request body accepted by POST /logs
+const maxHttpBodyBytes = 1024 * 1024
+
+// Returns a handler serving POST /logs
+func (h *ClientHandler) HttpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logs", h.handleHttpLogs)
+	return mux
+}
+
+// Returns a server for HttpHandler() at addr. Slow or idle clients are cut off after
+// idle_timeout_seconds, as on TCP, so they can't hold connections open indefinitely.
+func (h *ClientHandler) HttpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h.HttpHandler(),
+		ReadHeaderTimeout: h.idleTimeout, //Time to send the request headers
+		ReadTimeout:       h.idleTimeout, //Time to send the whole request, body included
+		IdleTimeout:       h.idleTimeout, //Time a keep-alive connection may wait for its next request
+	}
+}
+
+func (h *ClientHandler) handleHttpLogs(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.sendHttpResponse(w, http.StatusMethodNotAllowed, false, "method not allowed")
+		return
+	}
+
+	//Get client IP
+	clientIp := clientIpFromAddress(r.RemoteAddr)
+
+	body := bytes.Buffer{}
+	_, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, maxHttpBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.sendHttpResponse(w, http.StatusRequestEntityTooLarge, false, fmt.Sprintf("request body exceeds %d bytes", maxHttpBodyBytes))
+			return
+		}
+		h.sendHttpResponse(w, http.StatusBadRequest, false, "unable to read request body")
+		return
+	}
+
+	client := logwriting.ClientInfo{SourceIp: clientIp}
+
+	//Batches respond with a result per message
+	if batch, isBatch := h.splitBatch(body.Bytes()); isBatch {
+		results := h.handleBatch(batch, client)
+		h.sendHttpBody(w, batchHttpStatus(results), batchResponse(results))
+		return
+	}
+
+	err = h.handleMessage(body.Bytes(), client)
+	h.sendHttpResponse(w, httpStatus(err), err == nil, responseMessage(err))
+}
+
+// 200 if every message in the batch was written, 207 if only some were.
+// If none were, the status for the first rejection.
+func batchHttpStatus(results []error) int {
+
+	received := 0
+	for _, err := range results {
+		if err == nil {
+			received++
+		}
+	}
+
+	switch received {
+	case len(results):
+		return http.StatusOK
+	case 0:
+		return httpStatus(results[0])
+	default:
+		return http.StatusMultiStatus
+	}
+}
+
+// Maps the result of handleMessage() to an HTTP status code
+func httpStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, abuseprevention.ErrBlacklisted):
+		return http.StatusForbidden
+	case errors.Is(err, abuseprevention.ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errInternal):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (h *ClientHandler) sendHttpResponse(w http.ResponseWriter, status int, success bool, message string) {
+	h.sendHttpBody(w, status, clientResponse{Success: success, Message: message})
+}
+
+func (h *ClientHandler) sendHttpBody(w http.ResponseWriter, status int, body clientResponse) {
+
+	response, _ := json.Marshal(body)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(response)
+	if err != nil {
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:sendHttpBody():w.Write()", h.errlogPath)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+* FILE : 			schema_versions.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Older incoming message schemas, still accepted alongside the current
+		one (incoming_json_schema). Clients say which version a message follows
+		in its "schema_version_field"; messages without one, or at
+		"current_schema_version", are treated as the current version.
+
+		A message at an older version is validated against that version's
+		schema, then brought up to date by the upgrade rules of its version and
+		every newer one, in order:
+		- rename: 		Moves "field" to "to"
+		- set_default: 	Sets "field" to "value", if not already present
+		- drop: 		Removes "field"
+
+		The upgraded message is stamped with the current version (or, if the
+		current schema doesn't declare "schema_version_field", has it removed)
+		and validated against the current schema before it is formatted, so
+		every logfile only ever sees the latest shape.
+
+		Versions only apply to the default schema, not to "source_schemas".
+*/
+
+package clienthandling
+
+import (
+	"LoggingService/config"
+	"encoding/json"
+	"fmt"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Used when protocol_settings.schema_version_field is not set
+const defaultSchemaVersionField = "schema_version"
+
+// An older schema, and the rules upgrading its messages to the next version
+type schemaVersion struct {
+	version int
+	schema  *gojsonschema.Schema
+	upgrade []config.UpgradeRule
+}
+
+// Older versions, oldest first (sorted in config.ParseConfigFile())
+func newSchemaVersions(settings config.ProtocolSettings) []*schemaVersion {
+
+	var versions []*schemaVersion
+	for _, version := range settings.SchemaVersions {
+		versions = append(versions, &schemaVersion{
+			version: version.Version,
+			schema:  version.IncomingMessageValidator,
+			upgrade: version.Upgrade,
+		})
+	}
+	return versions
+}
+
+// Whether the schema lists field in its top-level properties
+func schemaDeclares(schema []byte, field string) bool {
+
+	var parsed struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(schema, &parsed); err != nil {
+		return false
+	}
+	_, exists := parsed.Properties[field]
+	return exists
+}
+
+// The older version a message claims to follow, or nil for the current version.
+// Messages that aren't valid JSON return nil, and are left to fail schema validation.
+func (h *ClientHandler) messageVersion(message []byte) (*schemaVersion, error) {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, nil
+	}
+
+	raw, exists := fields[h.schemaVersionField]
+	if !exists {
+		return nil, nil
+	}
+
+	var number int
+	if err := json.Unmarshal(raw, &number); err != nil {
+		return nil, fmt.Errorf("%s must be an integer, got %s", h.schemaVersionField, raw)
+	}
+	if number == h.currentSchemaVersion {
+		return nil, nil
+	}
+
+	for _, version := range h.schemaVersions {
+		if version.version == number {
+			return version, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown %s %d (current version is %d)", h.schemaVersionField, number, h.currentSchemaVersion)
+}
+
+// Applies the upgrade rules from the message's version onwards, then checks the result against the current schema.
+// A message that still doesn't fit is a configuration problem rather than the client's, so is rejected without a strike.
+func (h *ClientHandler) upgradeMessage(log map[string]interface{}, from *schemaVersion) error {
+
+	upgrading := false
+	for _, version := range h.schemaVersions {
+		if version == from {
+			upgrading = true
+		}
+		if !upgrading {
+			continue
+		}
+
+		for _, rule := range version.upgrade {
+			applyUpgradeRule(log, rule)
+		}
+	}
+
+	//The old version number would be wrong, and may not be allowed by the current schema at all
+	if h.stampSchemaVersion {
+		log[h.schemaVersionField] = h.currentSchemaVersion
+	} else {
+		delete(log, h.schemaVersionField)
+	}
+
+	upgraded, err := json.Marshal(log)
+	if err != nil {
+		h.logWriter.WriteErrorToFile(err.Error(), "internal:upgradeMessage():json.Marshal()", h.errlogPath)
+		return errInternal
+	}
+
+	err = h.CompareAgainstSchema(upgraded, h.schema)
+	if err != nil {
+		upgradeErr := fmt.Errorf("message upgraded from schema version %d does not fit the current schema: %w", from.version, err)
+		if h.errorSettings.InvalidMessage == "redirect_to_error_log" {
+			h.logWriter.WriteErrorToFile(upgradeErr.Error(), "schema upgrade", h.errlogPath)
+		}
+		return upgradeErr
+	}
+	return nil
+}
+
+func applyUpgradeRule(log map[string]interface{}, rule config.UpgradeRule) {
+
+	switch rule.Action {
+	case "rename":
+		if value, exists := log[rule.Field]; exists {
+			delete(log, rule.Field)
+			log[rule.To] = value
+		}
+	case "set_default":
+		if _, exists := log[rule.Field]; !exists {
+			log[rule.Field] = rule.Value
+		}
+	case "drop":
+		delete(log, rule.Field)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+* FILE : 			framing.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Splits a client's byte stream into individual messages ("frames"),
+		and encodes responses using the same framing.
+
+		Supported modes ("framing" in config.json):
+		- raw: 			A single Read() per message, no delimiting. Legacy behaviour.
+		- newline: 		Messages are terminated by '\n' (NDJSON). A trailing '\r' is stripped.
+		- length_prefix: 	Messages are preceded by a 4-byte big-endian payload length.
+
+		Newline and length-prefixed frames are read in a loop until complete, so
+		messages may span any number of TCP segments. Frames larger than the
+		configured maximum return ErrFrameTooLarge; a stream ending part-way
+		through a length-prefixed frame returns ErrTruncatedFrame.
+*/
+
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Framing mode strings to be converted to int
+type Mode int
+
+const (
+	Raw Mode = iota
+	Newline
+	LengthPrefix
+)
+
+// Size of the single read used by Raw framing
+const rawBufferSize = 4196
+
+// Size of the big-endian length header used by LengthPrefix framing
+const lengthHeaderSize = 4
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+var ErrTruncatedFrame = errors.New("connection closed part-way through a frame")
+
+// Converts a "framing" config value to a Mode
+func ParseMode(name string) (Mode, error) {
+	switch name {
+	case "raw":
+		return Raw, nil
+	case "newline":
+		return Newline, nil
+	case "length_prefix":
+		return LengthPrefix, nil
+	}
+	return Raw, fmt.Errorf("unknown framing mode %q", name)
+}
+
+type Reader struct {
+	mode          Mode
+	source        io.Reader
+	buffered      *bufio.Reader
+	scanner       *bufio.Scanner
+	maxFrameBytes int
+}
+
+func NewReader(source io.Reader, mode Mode, maxFrameBytes int) *Reader {
+
+	fr := &Reader{
+		mode:          mode,
+		source:        source,
+		maxFrameBytes: maxFrameBytes,
+	}
+
+	switch mode {
+	case Newline:
+		//+1 leaves room for the '\n' terminator itself
+		fr.scanner = bufio.NewScanner(source)
+		fr.scanner.Buffer(make([]byte, 0, 4096), maxFrameBytes+1)
+	case LengthPrefix:
+		fr.buffered = bufio.NewReader(source)
+	}
+
+	return fr
+}
+
+// Returns the next frame's payload.
+// Returns io.EOF once the stream ends cleanly between frames.
+func (fr *Reader) ReadFrame() ([]byte, error) {
+	switch fr.mode {
+	case Newline:
+		return fr.readLine()
+	case LengthPrefix:
+		return fr.readLengthPrefixed()
+	default:
+		return fr.readRaw()
+	}
+}
+
+func (fr *Reader) readRaw() ([]byte, error) {
+
+	buffer := make([]byte, rawBufferSize)
+	bytesRead, err := fr.source.Read(buffer)
+	if bytesRead == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	//Truncate trailing '\00' chars
+	return buffer[:bytesRead], nil
+}
+
+func (fr *Reader) readLine() ([]byte, error) {
+
+	if !fr.scanner.Scan() {
+		err := fr.scanner.Err()
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, ErrFrameTooLarge
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	//Strip CRLF line endings
+	return bytes.TrimSuffix(fr.scanner.Bytes(), []byte("\r")), nil
+}
+
+func (fr *Reader) readLengthPrefixed() ([]byte, error) {
+
+	//A clean EOF before the header is the end of the stream, not an error
+	header := make([]byte, lengthHeaderSize)
+	_, err := io.ReadFull(fr.buffered, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedFrame
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frameLength := binary.BigEndian.Uint32(header)
+	if uint64(frameLength) > uint64(fr.maxFrameBytes) {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, frameLength)
+	_, err = io.ReadFull(fr.buffered, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedFrame
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// Wraps a payload (usually a response) in the given framing
+func Encode(mode Mode, payload []byte) []byte {
+	switch mode {
+	case Newline:
+		return append(payload, '\n')
+	case LengthPrefix:
+		framed := make([]byte, lengthHeaderSize, lengthHeaderSize+len(payload))
+		binary.BigEndian.PutUint32(framed, uint32(len(payload)))
+		return append(framed, payload...)
+	default:
+		return payload
+	}
+}
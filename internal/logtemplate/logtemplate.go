@@ -0,0 +1,155 @@
+/*
+* FILE : 			logtemplate.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Parsing for the "template" logfile format: a Go text/template
+		executed once per log, with the log's fields as its data, e.g.
+		[{{.timestamp}}] {{.level | upper}} {{.source_id}}: {{.message}}
+
+		Helper functions available to templates:
+		- upper: 		{{.level | upper}}
+		- pad: 			{{.level | pad 5}}	Pads with spaces to at least N characters (negative N pads on the left)
+		- truncate: 	{{.message | truncate 80}}	Cuts to at most N characters
+		- json: 		{{.details | json}}	JSON-encodes the value
+		- default: 		{{.source_id | default "unknown"}}	Used when the field is missing or empty
+
+		Fields() lists the fields a template references, so config can check
+		them against the incoming_message_schema on startup.
+*/
+
+package logtemplate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+)
+
+var Funcs = template.FuncMap{
+	"upper":    upper,
+	"pad":      pad,
+	"truncate": truncate,
+	"json":     toJson,
+	"default":  withDefault,
+}
+
+// Parses a template with the helper functions available
+func Parse(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs).Parse(text)
+}
+
+// Names of the log fields referenced by a template, e.g. "level" for {{.level}} or {{$.level}}.
+// Fields inside {{with}} & {{range}} blocks are relative to another value, so aren't included.
+func Fields(tmpl *template.Template) []string {
+
+	var fields []string
+	seen := make(map[string]bool)
+	add := func(field string) {
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root, true, add)
+		}
+	}
+	return fields
+}
+
+// Visits every node, passing fields to add. atRoot is false once inside a block where dot has changed.
+func walk(node parse.Node, atRoot bool, add func(string)) {
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walk(child, atRoot, add)
+		}
+	case *parse.ActionNode:
+		walk(n.Pipe, atRoot, add)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walk(cmd, atRoot, add)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walk(arg, atRoot, add)
+		}
+	case *parse.FieldNode:
+		if atRoot {
+			add(n.Ident[0])
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			add(n.Ident[1])
+		}
+	case *parse.ChainNode:
+		walk(n.Node, atRoot, add)
+	case *parse.IfNode:
+		walk(n.Pipe, atRoot, add)
+		walk(n.List, atRoot, add)
+		walk(n.ElseList, atRoot, add)
+	case *parse.WithNode:
+		walk(n.Pipe, atRoot, add)
+		walk(n.List, false, add)
+		walk(n.ElseList, atRoot, add)
+	case *parse.RangeNode:
+		walk(n.Pipe, atRoot, add)
+		walk(n.List, false, add)
+		walk(n.ElseList, atRoot, add)
+	case *parse.TemplateNode:
+		walk(n.Pipe, atRoot, add)
+	}
+}
+
+func text(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func upper(value interface{}) string {
+	return strings.ToUpper(text(value))
+}
+
+func pad(width int, value interface{}) string {
+	if width < 0 {
+		return fmt.Sprintf("%*s", -width, text(value))
+	}
+	return fmt.Sprintf("%-*s", width, text(value))
+}
+
+func truncate(length int, value interface{}) string {
+	s := text(value)
+	if length < 0 || utf8.RuneCountInString(s) <= length {
+		return s
+	}
+	return string([]rune(s)[:length])
+}
+
+func toJson(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func withDefault(fallback interface{}, value interface{}) interface{} {
+	if text(value) == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,416 @@
+/*
+* FILE : 			filesink.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			fileSink is the Sink for writing to a file. It keeps the file open
+		and owns it from a single go routine, fed by a bounded channel. Client
+		handlers hand entries off and carry on, only blocking if the channel is full.
+
+		Entries are batched through a bufio.Writer, and flushed to the file when:
+		- The buffer reaches "buffer_size_bytes"
+		- "flush_interval_ms" has passed
+		- Flush() is called
+		- The sink is closed (server shutdown)
+
+		After a flush, the file is fsync'd according to the "fsync" policy:
+		- never: 		Leave it to the OS
+		- every_batch: 	After every flush
+		- interval: 	At most once every "fsync_interval_ms"
+
+		Write errors can't be returned to clients, so are sent to the error log.
+
+		Rotation (see rotation.go) is also handled from the writer go routine,
+		with compression & pruning left to a housekeeping go routine.
+
+		For the "json_array" format, the sink adds the "[", "," & "]" around
+		entries. The closing bracket is written after every flush, and cut off
+		again before the next, so the file is a well-formed array between flushes.
+
+		Formats with a header (e.g. csv) have it written at the start of every new file.
+*/
+
+package logwriting
+
+import (
+	"LoggingService/config"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fsync policy strings to be converted to int
+type fsyncPolicy int
+
+const (
+	FsyncNever fsyncPolicy = iota
+	FsyncEveryBatch
+	FsyncInterval
+)
+
+// Defaults for any buffering settings left out of config.json
+const (
+	defaultBufferSizeBytes  = 64 * 1024
+	defaultFlushInterval    = time.Second
+	defaultFsyncInterval    = time.Second
+	defaultWriteQueueLength = 1024
+)
+
+var errSinkClosed = errors.New("log sink has been closed")
+
+// Written around entries in "json_array" files
+const (
+	jsonArrayOpen      = "[\n"
+	jsonArraySeparator = ",\n"
+	jsonArrayClose     = "\n]\n"
+)
+
+// Queued work for the writer go routine
+type sinkRequest struct {
+	entries []string      //Written back to back
+	flushed chan struct{} //Set for Flush() requests; closed once flushed
+}
+
+type fileSink struct {
+	path          string
+	errorLogPath  string
+	file          *os.File
+	buffer        *bufio.Writer
+	bufferSize    int
+	flushInterval time.Duration
+	fsync         fsyncPolicy
+	fsyncInterval time.Duration
+	lastSync      time.Time
+	unsynced      bool
+	fileSize      int64 //Including anything still buffered, excluding any closing bracket
+	rotation      rotationPolicy
+	header        string //Written first in every new file
+
+	jsonArray    bool
+	arrayStarted bool //The file holds at least one entry
+	arrayClosed  bool //The file on disk ends with jsonArrayClose
+
+	queue     chan sinkRequest
+	queueLock sync.RWMutex //Held for writing only to close the queue
+	closed    bool
+	done      chan struct{}
+
+	//Rotated files to compress & prune, see rotation.go
+	rotatedQueue     chan string
+	rotatedFilesLock sync.Mutex
+	housekeepingDone chan struct{}
+}
+
+// Starts the writer go routine. The file is opened on the first write.
+func newFileSink(path string, errorLogPath string, settings config.LogfileSettings) *fileSink {
+
+	fs := &fileSink{
+		path:          path,
+		errorLogPath:  errorLogPath,
+		bufferSize:    defaultBufferSizeBytes,
+		flushInterval: defaultFlushInterval,
+		fsyncInterval: defaultFsyncInterval,
+		lastSync:      time.Now(),
+		rotation:      newRotationPolicy(settings),
+		header:        fileHeader(settings.Format, settings.ColumnOrder),
+		jsonArray:     settings.Format == "json_array",
+		done:          make(chan struct{}),
+
+		rotatedQueue:     make(chan string, rotatedQueueLength),
+		housekeepingDone: make(chan struct{}),
+	}
+
+	if settings.BufferSizeBytes > 0 {
+		fs.bufferSize = settings.BufferSizeBytes
+	}
+	if settings.FlushIntervalMs > 0 {
+		fs.flushInterval = time.Duration(settings.FlushIntervalMs) * time.Millisecond
+	}
+	if settings.FsyncIntervalMs > 0 {
+		fs.fsyncInterval = time.Duration(settings.FsyncIntervalMs) * time.Millisecond
+	}
+
+	switch settings.Fsync {
+	case "every_batch":
+		fs.fsync = FsyncEveryBatch
+	case "interval":
+		fs.fsync = FsyncInterval
+	default:
+		fs.fsync = FsyncNever
+	}
+
+	queueLength := defaultWriteQueueLength
+	if settings.WriteQueueLength > 0 {
+		queueLength = settings.WriteQueueLength
+	}
+	fs.queue = make(chan sinkRequest, queueLength)
+
+	go fs.run()
+	go fs.runHousekeeping()
+	return fs
+}
+
+// Queues entries to be written together. Blocks if the queue is full.
+func (fs *fileSink) Write(entries ...string) error {
+	return fs.enqueue(sinkRequest{entries: entries})
+}
+
+// Writes out everything queued so far, and flushes it to the file.
+// Blocks until done.
+func (fs *fileSink) Flush() error {
+	flushed := make(chan struct{})
+	err := fs.enqueue(sinkRequest{flushed: flushed})
+	if err != nil {
+		return err
+	}
+	<-flushed
+	return nil
+}
+
+// Writes out everything queued, flushes, syncs & closes the file.
+// Blocks until done, including compressing & pruning any files rotated out.
+func (fs *fileSink) Close() error {
+	fs.queueLock.Lock()
+	if !fs.closed {
+		fs.closed = true
+		close(fs.queue)
+	}
+	fs.queueLock.Unlock()
+
+	<-fs.done
+	<-fs.housekeepingDone
+	return nil
+}
+
+func (fs *fileSink) enqueue(request sinkRequest) error {
+	fs.queueLock.RLock()
+	defer fs.queueLock.RUnlock()
+
+	if fs.closed {
+		return errSinkClosed
+	}
+	fs.queue <- request
+	return nil
+}
+
+// Writer go routine. Sole owner of the file & buffer.
+func (fs *fileSink) run() {
+
+	defer close(fs.done)
+	defer close(fs.rotatedQueue)
+
+	ticker := time.NewTicker(fs.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case request, ok := <-fs.queue:
+			if !ok {
+				fs.flush(true)
+				fs.closeFile()
+				return
+			}
+			for _, entry := range request.entries {
+				fs.writeEntry(entry)
+			}
+			if request.flushed != nil {
+				fs.flush(false)
+				close(request.flushed)
+			}
+
+		case <-ticker.C:
+			fs.rotateIfDue(0)
+			fs.flush(false)
+		}
+	}
+}
+
+func (fs *fileSink) writeEntry(entry string) {
+
+	fs.rotateIfDue(len(entry))
+	if !fs.openFile() {
+		return
+	}
+
+	if fs.fileSize == 0 {
+		entry = fs.header + entry
+	}
+
+	if fs.jsonArray {
+		if fs.arrayStarted {
+			entry = jsonArraySeparator + entry
+		} else {
+			entry = jsonArrayOpen + entry
+		}
+		fs.arrayStarted = true
+	}
+
+	//Flush first if this entry would take the buffer past its limit
+	if fs.buffer.Buffered() > 0 && fs.buffer.Buffered()+len(entry) > fs.bufferSize {
+		fs.flush(false)
+	}
+
+	//An entry bigger than the buffer goes straight to the file, so make room for it first
+	if fs.arrayClosed && len(entry) > fs.buffer.Available() && !fs.reopenArray() {
+		return
+	}
+
+	if _, err := fs.buffer.WriteString(entry); err != nil {
+		fs.reportError(err, "internal:fileSink.writeEntry():buffer.WriteString()")
+		return
+	}
+	fs.fileSize += int64(len(entry))
+}
+
+// Flushes the buffer to the file, and fsyncs as per policy.
+// forceSync syncs any unsynced data regardless of policy (used on shutdown).
+func (fs *fileSink) flush(forceSync bool) {
+
+	if fs.file == nil {
+		return
+	}
+
+	if fs.buffer.Buffered() > 0 {
+		if fs.arrayClosed && !fs.reopenArray() {
+			return
+		}
+		if err := fs.buffer.Flush(); err != nil {
+			fs.reportError(err, "internal:fileSink.flush():buffer.Flush()")
+			return
+		}
+		fs.unsynced = true
+	}
+
+	//Also covers entries too big for the buffer, which skip it
+	if fs.jsonArray && fs.arrayStarted && !fs.arrayClosed {
+		fs.closeArray()
+		fs.unsynced = true
+	}
+
+	if !fs.unsynced {
+		return
+	}
+
+	switch {
+	case forceSync, fs.fsync == FsyncEveryBatch:
+	case fs.fsync == FsyncInterval && time.Since(fs.lastSync) >= fs.fsyncInterval:
+	default:
+		return
+	}
+
+	if err := fs.file.Sync(); err != nil {
+		fs.reportError(err, "internal:fileSink.flush():file.Sync()")
+		return
+	}
+	fs.unsynced = false
+	fs.lastSync = time.Now()
+}
+
+// Opens the logfile if it isn't already. Returns false if it can't be opened.
+func (fs *fileSink) openFile() bool {
+
+	if fs.file != nil {
+		return true
+	}
+
+	//Routed paths may be in directories that don't exist yet
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0755); err != nil {
+		fs.reportError(fmt.Errorf("failed to create directory: %w", err), "internal:fileSink.openFile()")
+		return false
+	}
+
+	// Open the file in append mode. Create it if it doesn't exist.
+	// JSON arrays are read back to check how the file ends.
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if fs.jsonArray {
+		flags = os.O_APPEND | os.O_CREATE | os.O_RDWR
+	}
+	f, err := os.OpenFile(fs.path, flags, 0644)
+	if err != nil {
+		fs.reportError(fmt.Errorf("failed to open file: %w", err), "internal:fileSink.openFile()")
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		fs.reportError(fmt.Errorf("failed to stat file: %w", err), "internal:fileSink.openFile()")
+		return false
+	}
+
+	fs.file = f
+	fs.buffer = bufio.NewWriterSize(f, fs.bufferSize)
+	fs.fileSize = info.Size()
+	fs.startRotationPeriod(info)
+
+	if fs.jsonArray {
+		fs.arrayStarted = info.Size() > 0
+		fs.arrayClosed = fs.endsWithArrayClose(info.Size())
+		if fs.arrayClosed {
+			fs.fileSize -= int64(len(jsonArrayClose))
+		}
+	}
+	return true
+}
+
+// Whether an existing file already ends with the closing bracket.
+// If not (e.g. the server stopped mid-flush), appending carries on the array regardless.
+func (fs *fileSink) endsWithArrayClose(size int64) bool {
+
+	if size < int64(len(jsonArrayClose)) {
+		return false
+	}
+
+	tail := make([]byte, len(jsonArrayClose))
+	if _, err := fs.file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		fs.reportError(fmt.Errorf("failed to read end of file: %w", err), "internal:fileSink.endsWithArrayClose()")
+		return false
+	}
+	return string(tail) == jsonArrayClose
+}
+
+// Cuts the closing bracket off the file, so more entries can be appended
+func (fs *fileSink) reopenArray() bool {
+
+	info, err := fs.file.Stat()
+	if err != nil {
+		fs.reportError(fmt.Errorf("failed to stat file: %w", err), "internal:fileSink.reopenArray()")
+		return false
+	}
+	if err := fs.file.Truncate(info.Size() - int64(len(jsonArrayClose))); err != nil {
+		fs.reportError(fmt.Errorf("failed to truncate file: %w", err), "internal:fileSink.reopenArray()")
+		return false
+	}
+	fs.arrayClosed = false
+	return true
+}
+
+// Appends the closing bracket, after everything buffered has been written
+func (fs *fileSink) closeArray() {
+
+	if _, err := fs.file.WriteString(jsonArrayClose); err != nil {
+		fs.reportError(err, "internal:fileSink.closeArray()")
+		return
+	}
+	fs.arrayClosed = true
+}
+
+func (fs *fileSink) closeFile() {
+
+	if fs.file == nil {
+		return
+	}
+
+	if err := fs.file.Close(); err != nil {
+		fs.reportError(err, "internal:fileSink.closeFile()")
+	}
+	fs.file = nil
+	fs.buffer = nil
+}
+
+func (fs *fileSink) reportError(err error, category string) {
+	writeError(err.Error(), category, fs.errorLogPath)
+}
@@ -0,0 +1,240 @@
+/*
+* FILE : 			formats.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Output formats beyond JSON & plaintext, used by output.formatEntry().
+
+		csv:	RFC 4180 records (via encoding/csv), one per log, in column_order.
+				Nested objects & arrays are JSON-encoded into their cell. Each new
+				file starts with a header row of the column names.
+
+		logfmt:	key=value pairs in column_order, one log per line. Values are
+				quoted (Go-style escapes) if they contain spaces, '=', quotes,
+				backslashes or control characters.
+
+		cef:	Common Event Format. Header slots come from "cef_settings" (with
+				{field} placeholders), escaping '\' & '|'. Fields in column_order
+				become extensions, escaping '\', '=' & line breaks.
+
+		template:	The user's text/template (see internal/logtemplate), executed
+				with the log's fields. A newline is added unless it ends in one.
+*/
+
+package logwriting
+
+import (
+	"LoggingService/config"
+	"encoding/csv"
+	"encoding/json"
+	"maps"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const cefVersion = "0"
+
+// Escaping for CEF header slots & extension values
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r\n", " ", "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+)
+
+// Written at the start of each new (or freshly rotated) file, if the format has one
+func fileHeader(format string, columnOrder []string) string {
+	if format == "csv" {
+		return csvRecord(columnOrder)
+	}
+	return ""
+}
+
+func (out *output) formatCsv(log map[string]interface{}) (string, error) {
+
+	cells := make([]string, len(out.columnOrder))
+	for i, column := range out.columnOrder {
+		cell, err := valueText(log[column])
+		if err != nil {
+			return "", err
+		}
+		cells[i] = cell
+	}
+	return csvRecord(cells), nil
+}
+
+// Strings are written as-is, missing fields are left empty, and anything else
+// (numbers, booleans, nested objects & arrays) is JSON-encoded
+func valueText(value interface{}) (string, error) {
+
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Quotes & escapes cells as needed, terminated by CRLF as per RFC 4180
+func csvRecord(cells []string) string {
+
+	var sb strings.Builder
+	writer := csv.NewWriter(&sb)
+	writer.UseCRLF = true
+
+	//Writing to a strings.Builder can't fail
+	writer.Write(cells)
+	writer.Flush()
+	return sb.String()
+}
+
+func (out *output) formatLogfmt(log map[string]interface{}) (string, error) {
+
+	var sb strings.Builder
+	for _, column := range out.columnOrder {
+		value, exists := log[column]
+		if !exists {
+			continue
+		}
+
+		text, err := valueText(value)
+		if err != nil {
+			return "", err
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(logfmtKey(column))
+		sb.WriteByte('=')
+		sb.WriteString(logfmtValue(text))
+	}
+	sb.WriteByte('\n')
+	return sb.String(), nil
+}
+
+// Keys can't be quoted, so anything that would end one is replaced with '_'
+func logfmtKey(key string) string {
+	return strings.Map(func(char rune) rune {
+		if char <= ' ' || char == '=' || char == '"' || !unicode.IsPrint(char) {
+			return '_'
+		}
+		return char
+	}, key)
+}
+
+func logfmtValue(text string) string {
+
+	if text == "" {
+		return `""`
+	}
+
+	needsQuotes := strings.IndexFunc(text, func(char rune) bool {
+		return char <= ' ' || char == '=' || char == '"' || char == '\\' || !unicode.IsPrint(char)
+	}) >= 0
+
+	if needsQuotes {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+func (out *output) formatCef(log map[string]interface{}) (string, error) {
+
+	cef := out.cef
+	severity := expandPlaceholders(cef.Severity, log)
+	if mapped, exists := cef.SeverityMap[severity]; exists {
+		severity = mapped
+	}
+
+	var sb strings.Builder
+	sb.WriteString("CEF:" + cefVersion)
+	for _, header := range []string{
+		expandPlaceholders(cef.Vendor, log),
+		expandPlaceholders(cef.Product, log),
+		expandPlaceholders(cef.DeviceVersion, log),
+		expandPlaceholders(cef.SignatureId, log),
+		expandPlaceholders(cef.Name, log),
+		severity,
+	} {
+		sb.WriteByte('|')
+		sb.WriteString(cefHeaderEscaper.Replace(header))
+	}
+	sb.WriteByte('|')
+
+	//Extensions, for each field in column_order
+	extensions := 0
+	for _, column := range out.columnOrder {
+		value, exists := log[column]
+		if !exists || value == nil {
+			continue
+		}
+
+		text, err := valueText(value)
+		if err != nil {
+			return "", err
+		}
+
+		key := cefExtensionKey(cef, column)
+		if extensions > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(key)
+		sb.WriteByte('=')
+		sb.WriteString(cefExtensionEscaper.Replace(text))
+		extensions++
+	}
+	sb.WriteByte('\n')
+	return sb.String(), nil
+}
+
+// The mapped extension key for a field. Unmapped fields use their own name,
+// minus anything but letters & digits.
+func cefExtensionKey(cef config.CefSettings, field string) string {
+
+	if key, exists := cef.Extensions[field]; exists {
+		return key
+	}
+
+	return strings.Map(func(char rune) rune {
+		if char < unicode.MaxASCII && (unicode.IsLetter(char) || unicode.IsDigit(char)) {
+			return char
+		}
+		return -1
+	}, field)
+}
+
+// Fills in {field} placeholders with the log's values. Missing fields are left empty.
+func expandPlaceholders(template string, log map[string]interface{}) string {
+	return config.PathPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		text, err := valueText(log[placeholder[1:len(placeholder)-1]])
+		if err != nil {
+			return ""
+		}
+		return text
+	})
+}
+
+func (out *output) formatTemplate(log map[string]interface{}) (string, error) {
+
+	//Referenced fields missing from this log are rendered empty, rather than as "<no value>"
+	data := maps.Clone(log)
+	for _, field := range out.templateFields {
+		if data[field] == nil {
+			data[field] = ""
+		}
+	}
+
+	var sb strings.Builder
+	if err := out.template.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(sb.String(), "\n") {
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
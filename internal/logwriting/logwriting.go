@@ -2,77 +2,127 @@
 * FILE : 			logwriting.go
 * FIRST VERSION : 	2025-02-22
 * DESCRIPTION :
-			Upon construction, notes down the logfile format specified
-		in config.json.
+			Upon construction, notes down the logfile format of each sink
+		specified in config.json.
 
 		Provides functions to allow threadsafe writing to logfiles in the
-		configured format.
+		configured format. Each log is formatted once per sink, then handed to
+		that sink (see sink.go); errors are written synchronously.
+
+		Each sink's router (see routing.go) picks which file a log goes to.
 */
 
 package logwriting
 
 import (
 	"LoggingService/config"
+	"LoggingService/internal/logtemplate"
+	"LoggingService/internal/timestamps"
 	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 )
 
-var logFileMutex sync.Mutex
 var errFileMutex sync.Mutex
 
 // Log format strings to be converted to int
 type logFormat int
 
 const (
-	Json logFormat = iota
+	Json logFormat = iota //Legacy: each object followed by ",\n"
 	Plaintext
+	Ndjson    //One object per line
+	JsonArray //Objects in a single array; the sink maintains the brackets & commas
+	Csv
+	Logfmt
+	Cef
+	Template
 	Error
 )
 
-// TimeFormats maps layout names to their corresponding time format strings.
-var TimeFormats = map[string]string{
-	"ANSIC":       time.ANSIC,
-	"UnixDate":    time.UnixDate,
-	"RubyDate":    time.RubyDate,
-	"RFC822":      time.RFC822,
-	"RFC822Z":     time.RFC822Z,
-	"RFC850":      time.RFC850,
-	"RFC1123":     time.RFC1123,
-	"RFC1123Z":    time.RFC1123Z,
-	"RFC3339":     time.RFC3339,
-	"RFC3339Nano": time.RFC3339Nano,
-	"Kitchen":     time.Kitchen,
+type LogWriter struct {
+	outputs []output
 }
 
-type LogWriter struct {
-	format          logFormat
-	fieldDelimiter  string
-	entryDelimiter  string
-	columnOrder     []string
-	timestampFormat string
+// A sink, and how logs are formatted for it
+type output struct {
+	format         logFormat
+	fieldDelimiter string
+	entryDelimiter string
+	columnOrder    []string
+	timestamp      timestamps.Format
+	cef            config.CefSettings
+	template       *template.Template
+	templateFields []string
+	router         *router
+}
+
+// A log formatted for one sink, and the file it's routed to
+type formattedEntry struct {
+	path string
+	text string
 }
 
-func New(logSettings config.LogfileSettings) *LogWriter {
+// A log formatted once for each sink, in the order sinks are configured
+type FormattedLog []formattedEntry
+
+// Starts a sink for each configured logfile. Call Close() on shutdown to flush them.
+func New(logSettings config.LogfileSettings, errorLogPath string) *LogWriter {
+
+	sinkSettings := logSettings.SinkSettings()
+	lw := &LogWriter{outputs: make([]output, len(sinkSettings))}
+
+	for i, settings := range sinkSettings {
+		var convertedFormat logFormat
+		switch settings.Format {
+		case "json":
+			convertedFormat = Json
+		case "plaintext":
+			convertedFormat = Plaintext
+		case "ndjson":
+			convertedFormat = Ndjson
+		case "json_array":
+			convertedFormat = JsonArray
+		case "csv":
+			convertedFormat = Csv
+		case "logfmt":
+			convertedFormat = Logfmt
+		case "cef":
+			convertedFormat = Cef
+		case "template":
+			convertedFormat = Template
+		default:
+			convertedFormat = Error
+		}
+
+		lw.outputs[i] = output{
+			format:         convertedFormat,
+			fieldDelimiter: settings.PlaintextFieldDelimiter,
+			entryDelimiter: settings.PlaintextEntryDelimiter,
+			columnOrder:    settings.ColumnOrder,
+			timestamp:      settings.Timestamp,
+			cef:            settings.Cef,
+			router:         newRouter(settings, errorLogPath),
+		}
 
-	var convertedFormat logFormat
-	if logSettings.Format == "json" {
-		convertedFormat = Json
-	} else if logSettings.Format == "plaintext" {
-		convertedFormat = Plaintext
-	} else {
-		convertedFormat = Error
+		if settings.CompiledTemplate != nil {
+			lw.outputs[i].template = settings.CompiledTemplate
+			lw.outputs[i].templateFields = logtemplate.Fields(settings.CompiledTemplate)
+		}
 	}
 
-	return &LogWriter{
-		format:          convertedFormat,
-		fieldDelimiter:  logSettings.PlaintextFieldDelimiter,
-		entryDelimiter:  logSettings.PlaintextEntryDelimiter,
-		columnOrder:     logSettings.ColumnOrder,
-		timestampFormat: logSettings.TimestampFormat,
+	return lw
+}
+
+// Writes out all queued logs and closes every sink.
+// No further logs can be written afterwards.
+func (lw *LogWriter) Close() {
+	for _, out := range lw.outputs {
+		out.router.close()
 	}
 }
 
@@ -96,6 +146,10 @@ func TestLogfilePaths(log string, errorLog string) (bool, error) {
 }
 
 func (lw *LogWriter) WriteErrorToFile(message string, category string, path string) error {
+	return writeError(message, category, path)
+}
+
+func writeError(message string, category string, path string) error {
 	errFileMutex.Lock()
 	defer errFileMutex.Unlock()
 
@@ -114,68 +168,143 @@ func (lw *LogWriter) WriteErrorToFile(message string, category string, path stri
 	return nil
 }
 
-func (lw *LogWriter) WriteLogToFile(logEntry string, path string) error {
-	logFileMutex.Lock()
-	defer logFileMutex.Unlock()
-
-	// Open the file in append mode. Create it if it doesn't exist.
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer f.Close()
-
-	if _, err := f.WriteString(logEntry); err != nil {
-		return fmt.Errorf("failed to log to file: %w", err)
+// Queues a log to be written to each sink.
+// Only blocks if a sink's write queue is full.
+func (lw *LogWriter) WriteLogToFile(formattedLog FormattedLog) error {
+	for i, out := range lw.outputs {
+		if err := out.router.write(formattedLog[i].path, formattedLog[i].text); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func (lw *LogWriter) FormatLogEntry(log map[string]interface{}, clientIp string) (string, error) {
+// Queues a batch of logs. Those routed to the same file are written back to back.
+func (lw *LogWriter) WriteLogsToFile(formattedLogs []FormattedLog) error {
+	for i, out := range lw.outputs {
 
-	timestampIncluded := false
-	sourceIpIncluded := false
-	for _, column := range lw.columnOrder {
-		if column == "timestamp" {
-			timestampIncluded = true
+		//Group by file, keeping the batch order within each
+		var paths []string
+		entries := make(map[string][]string)
+		for _, formattedLog := range formattedLogs {
+			entry := formattedLog[i]
+			if _, exists := entries[entry.path]; !exists {
+				paths = append(paths, entry.path)
+			}
+			entries[entry.path] = append(entries[entry.path], entry.text)
 		}
-		if column == "source_ip" {
-			sourceIpIncluded = true
+
+		for _, path := range paths {
+			if err := out.router.write(path, entries[path]...); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	if timestampIncluded {
-		log["timestamp"] = time.Now().Format(TimeFormats[lw.timestampFormat])
-	}
+// Server-determined details about the client that sent a log
+type ClientInfo struct {
+	SourceIp string
+	ClientCN string //Subject CN of the client certificate, if mutual TLS is in use
+}
 
-	if sourceIpIncluded {
-		log["source_ip"] = clientIp
+// When a log happened, as far as the server can tell
+type LogTimes struct {
+	Received     time.Time
+	Event        time.Time //From the client's event_time_field, else Received
+	SkewExceeded bool      //Event time was further from Received than max_clock_skew_seconds allows
+}
 
-	}
+// Formats a log for every sink. Every sink gets the same times, albeit formatted differently.
+func (lw *LogWriter) FormatLogEntry(log map[string]interface{}, client ClientInfo, times LogTimes) (FormattedLog, error) {
 
-	//If simple JSON formatting, just re-marshal the map with the new fields added.
-	if lw.format == Json {
-		filteredLog := make(map[string]interface{})
-		for _, column := range lw.columnOrder {
-			if value, exists := log[column]; exists {
-				filteredLog[column] = value
-			}
+	formattedLog := make(FormattedLog, len(lw.outputs))
+	for i := range lw.outputs {
+		text, err := lw.outputs[i].formatEntry(log, client, times)
+		if err != nil {
+			return nil, err
 		}
+		formattedLog[i] = formattedEntry{path: lw.outputs[i].router.pathFor(log), text: text}
+	}
+	return formattedLog, nil
+}
+
+func (out *output) formatEntry(log map[string]interface{}, client ClientInfo, times LogTimes) (string, error) {
 
-		formattedLog, err := json.Marshal(filteredLog)
-		finalLog := fmt.Sprintf("%s%s", formattedLog, ",\n")
+	//Fill in the server-internal fields. Besides column_order, they may be used by
+	//routes, path placeholders & CEF headers. Only fields in column_order are written.
+	log["timestamp"] = out.timestamp.Value(times.Received)
+	log["source_ip"] = client.SourceIp
+	log["client_cn"] = client.ClientCN
+	log["received_time"] = out.timestamp.Value(times.Received)
+	log["event_time"] = out.timestamp.Value(times.Event)
+	log["clock_skew_exceeded"] = times.SkewExceeded
+
+	//JSON formats re-marshal the log with the new fields added, keys in column order
+	switch out.format {
+	case Json:
+		formattedLog, err := out.marshalOrdered(log)
 		if err != nil {
 			return "", err
 		}
-		return string(finalLog), nil
+		return formattedLog + ",\n", nil
+	case Ndjson:
+		formattedLog, err := out.marshalOrdered(log)
+		if err != nil {
+			return "", err
+		}
+		return formattedLog + "\n", nil
+	case JsonArray:
+		//Separators are added by the sink, which knows what's already in the file
+		return out.marshalOrdered(log)
+	case Csv:
+		return out.formatCsv(log)
+	case Logfmt:
+		return out.formatLogfmt(log)
+	case Cef:
+		return out.formatCef(log)
+	case Template:
+		return out.formatTemplate(log)
 	}
 
 	//Else, format it using the delimiters
 	var sb strings.Builder
-	for _, column := range lw.columnOrder {
-		sb.WriteString(fmt.Sprintf("%v%s", log[column], lw.fieldDelimiter))
+	for _, column := range out.columnOrder {
+		sb.WriteString(fmt.Sprintf("%v%s", log[column], out.fieldDelimiter))
+	}
+	sb.WriteString(out.entryDelimiter)
+	return sb.String(), nil
+}
+
+// Marshals the fields in column_order to a JSON object, keeping that order.
+// Fields missing from the log are left out.
+func (out *output) marshalOrdered(log map[string]interface{}) (string, error) {
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for _, column := range out.columnOrder {
+		value, exists := log[column]
+		if !exists {
+			continue
+		}
+
+		key, err := json.Marshal(column)
+		if err != nil {
+			return "", err
+		}
+		encodedValue, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.Write(key)
+		sb.WriteByte(':')
+		sb.Write(encodedValue)
 	}
-	sb.WriteString(lw.entryDelimiter)
+	sb.WriteByte('}')
 	return sb.String(), nil
 }
@@ -0,0 +1,361 @@
+/*
+* FILE : 			rotation.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Size- and time-based rotation of the logfile, run from the fileSink's
+		go routine. As that go routine is the only thing touching the file,
+		rotation never races with a write.
+
+		The logfile is rotated when it would grow past "rotate_max_bytes", or
+		when the hour/day it was started in ("rotate_interval") has passed.
+		Rotated files are renamed by either:
+		- timestamp: 	logs.txt --> logs.20250222-153000.txt
+		- index: 		logs.txt --> logs.txt.1 (older files shift up: .1 --> .2, etc)
+
+		Timestamps are when the file was rotated for size, or when the file was
+		started for time-based rotations; so a day's logs are named after that
+		day, not the day just beginning.
+
+		Rotated files can optionally be gzip'd (".gz" appended), and the oldest
+		removed once there are more than "max_rotated_files".
+
+		Only the rename happens in the writer go routine. Compressing and
+		pruning are handed to a second, housekeeping go routine, so writes
+		carry on meanwhile. It works through rotated files one at a time, so
+		pruning never deletes a file it's still compressing. Shifting indexed
+		files holds rotatedFilesLock, waiting out any compression in progress.
+*/
+
+package logwriting
+
+import (
+	"LoggingService/config"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rotation interval strings to be converted to int
+type rotateInterval int
+
+const (
+	RotateNever rotateInterval = iota
+	RotateHourly
+	RotateDaily
+)
+
+// Rotated file naming strings to be converted to int
+type rotateNaming int
+
+const (
+	NameByTimestamp rotateNaming = iota
+	NameByIndex
+)
+
+const rotatedTimestampFormat = "20060102-150405"
+
+// Rotated files waiting on the housekeeping go routine, before rotation blocks
+const rotatedQueueLength = 16
+
+type rotationPolicy struct {
+	maxBytes  int64
+	interval  rotateInterval
+	naming    rotateNaming
+	maxFiles  int
+	compress  bool
+	periodEnd time.Time //When the current file's hour/day is up
+	started   time.Time //When the current file was started (last written, for existing files)
+}
+
+func newRotationPolicy(settings config.LogfileSettings) rotationPolicy {
+
+	policy := rotationPolicy{
+		maxBytes: settings.RotateMaxBytes,
+		maxFiles: settings.MaxRotatedFiles,
+		compress: settings.CompressRotated,
+	}
+
+	switch settings.RotateInterval {
+	case "hourly":
+		policy.interval = RotateHourly
+	case "daily":
+		policy.interval = RotateDaily
+	}
+
+	if settings.RotateNaming == "index" {
+		policy.naming = NameByIndex
+	}
+
+	return policy
+}
+
+// End of the hour/day containing t
+func (rp *rotationPolicy) nextBoundary(t time.Time) time.Time {
+	switch rp.interval {
+	case RotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(time.Hour)
+	case RotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// Called once the logfile is opened. An existing file is treated as
+// belonging to the period it was last written in.
+func (fs *fileSink) startRotationPeriod(info os.FileInfo) {
+
+	started := time.Now()
+	if info.Size() > 0 {
+		started = info.ModTime()
+	}
+	fs.rotation.started = started
+	fs.rotation.periodEnd = fs.rotation.nextBoundary(started)
+}
+
+// Rotates if the next entry would take the file past its size limit,
+// or if its time period has ended. Only non-empty files are rotated.
+func (fs *fileSink) rotateIfDue(nextEntryBytes int) {
+
+	if fs.file == nil || fs.fileSize == 0 {
+		return
+	}
+
+	sizeDue := fs.rotation.maxBytes > 0 && fs.fileSize+int64(nextEntryBytes) > fs.rotation.maxBytes
+	timeDue := fs.rotation.interval != RotateNever && !time.Now().Before(fs.rotation.periodEnd)
+
+	if timeDue {
+		fs.rotate(fs.rotation.started)
+	} else if sizeDue {
+		fs.rotate(time.Now())
+	}
+}
+
+// Closes the logfile and moves it aside, leaving compression & pruning to the housekeeping go routine.
+// stamp is the time used in timestamp naming. The new logfile is opened by the next write.
+func (fs *fileSink) rotate(stamp time.Time) {
+
+	fs.flush(true)
+	fs.closeFile()
+
+	rotatedPath, ok := fs.moveAside(stamp)
+	if !ok {
+		return
+	}
+
+	if fs.rotation.compress || fs.rotation.naming == NameByTimestamp {
+		fs.rotatedQueue <- rotatedPath
+	}
+}
+
+// Renames the logfile to its rotated name, and returns that name. Returns false on failure.
+func (fs *fileSink) moveAside(stamp time.Time) (string, bool) {
+
+	//Indexed files are renamed along with it, so mustn't be mid-compression
+	if fs.rotation.naming == NameByIndex {
+		fs.rotatedFilesLock.Lock()
+		defer fs.rotatedFilesLock.Unlock()
+	}
+
+	rotatedPath, err := fs.nextRotatedPath(stamp)
+	if err != nil {
+		fs.reportError(err, "internal:fileSink.rotate():nextRotatedPath()")
+		return "", false
+	}
+
+	if err := os.Rename(fs.path, rotatedPath); err != nil {
+		fs.reportError(err, "internal:fileSink.rotate():os.Rename()")
+		return "", false
+	}
+	return rotatedPath, true
+}
+
+// Housekeeping go routine. Compresses each rotated file, then prunes old ones.
+// Runs until the writer go routine closes rotatedQueue.
+func (fs *fileSink) runHousekeeping() {
+
+	defer close(fs.housekeepingDone)
+
+	for rotatedPath := range fs.rotatedQueue {
+		fs.rotatedFilesLock.Lock()
+
+		if fs.rotation.compress {
+			fs.compressRotated(rotatedPath)
+		}
+
+		if fs.rotation.naming == NameByTimestamp {
+			fs.pruneTimestampedFiles()
+		}
+
+		fs.rotatedFilesLock.Unlock()
+	}
+}
+
+// Compresses a rotated file. Indexed files may have shifted up since it was queued,
+// so every uncompressed one is done instead. Timestamped files pruned since are skipped.
+func (fs *fileSink) compressRotated(rotatedPath string) {
+
+	paths := []string{rotatedPath}
+	if fs.rotation.naming == NameByIndex {
+		paths = nil
+		for i := 1; fs.rotatedFileExists(fs.indexedPath(i)); i++ {
+			paths = append(paths, fs.indexedPath(i))
+		}
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := compressFile(path); err != nil {
+			fs.reportError(err, "internal:fileSink.compressRotated():compressFile()")
+		}
+	}
+}
+
+// Name for the file being rotated out. With index naming, shifts existing
+// rotated files up by one (deleting any past the limit) to free up ".1".
+func (fs *fileSink) nextRotatedPath(stamp time.Time) (string, error) {
+
+	if fs.rotation.naming == NameByTimestamp {
+		ext := filepath.Ext(fs.path)
+		base := strings.TrimSuffix(fs.path, ext) + "." + stamp.Format(rotatedTimestampFormat)
+
+		//Several rotations can share a second, e.g. a file started the moment the last was rotated for size
+		candidate := base + ext
+		for n := 1; fs.rotatedFileExists(candidate); n++ {
+			candidate = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		return candidate, nil
+	}
+
+	//Find the highest index in use
+	highest := 0
+	for fs.rotatedFileExists(fs.indexedPath(highest + 1)) {
+		highest++
+	}
+
+	for i := highest; i >= 1; i-- {
+		from := fs.existingRotatedFile(fs.indexedPath(i))
+		if fs.rotation.maxFiles > 0 && i >= fs.rotation.maxFiles {
+			if err := os.Remove(from); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		to := fs.indexedPath(i + 1)
+		if strings.HasSuffix(from, ".gz") {
+			to += ".gz"
+		}
+		if err := os.Rename(from, to); err != nil {
+			return "", err
+		}
+	}
+
+	return fs.indexedPath(1), nil
+}
+
+func (fs *fileSink) indexedPath(index int) string {
+	return fs.path + "." + strconv.Itoa(index)
+}
+
+// Checks for a rotated file, whether or not it has been compressed
+func (fs *fileSink) rotatedFileExists(path string) bool {
+	_, err := os.Stat(fs.existingRotatedFile(path))
+	return err == nil
+}
+
+// Returns the compressed version of path if that's what exists on disk
+func (fs *fileSink) existingRotatedFile(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			return path + ".gz"
+		}
+	}
+	return path
+}
+
+// Deletes the oldest timestamped files beyond max_rotated_files
+func (fs *fileSink) pruneTimestampedFiles() {
+
+	if fs.rotation.maxFiles <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(fs.path)
+	base := strings.TrimSuffix(filepath.Base(fs.path), ext)
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(base) + `\.\d{8}-\d{6}(-\d+)?` + regexp.QuoteMeta(ext) + `(\.gz)?$`)
+
+	dir := filepath.Dir(fs.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fs.reportError(err, "internal:fileSink.pruneTimestampedFiles():os.ReadDir()")
+		return
+	}
+
+	var rotated []string
+	for _, entry := range entries {
+		if !entry.IsDir() && pattern.MatchString(entry.Name()) {
+			rotated = append(rotated, entry.Name())
+		}
+	}
+
+	//Oldest first: by timestamp, then by any "-N" suffix
+	timestampStart := len(base) + 1
+	timestampEnd := timestampStart + len(rotatedTimestampFormat)
+	slices.SortFunc(rotated, func(a string, b string) int {
+		a, b = strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz")
+		return cmp.Or(
+			strings.Compare(a[timestampStart:timestampEnd], b[timestampStart:timestampEnd]),
+			len(a)-len(b),
+			strings.Compare(a, b),
+		)
+	})
+
+	for len(rotated) > fs.rotation.maxFiles {
+		if err := os.Remove(filepath.Join(dir, rotated[0])); err != nil {
+			fs.reportError(err, "internal:fileSink.pruneTimestampedFiles():os.Remove()")
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// Replaces path with a gzip'd copy at path + ".gz"
+func compressFile(path string) error {
+
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	compressor := gzip.NewWriter(destination)
+	_, err = io.Copy(compressor, source)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	source.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,203 @@
+/*
+* FILE : 			routing.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			A router picks the file each log is written to, for a single entry
+		in logfile_settings (or sinks). Routes are checked in order, and the
+		first whose field matches decides the path. Logs matching no route go to
+		the sink's own "path", the default route.
+
+		Paths may contain placeholders naming a field, e.g.
+		"logs/{source_id}/{level}.log", which are filled in from each log.
+		Values are sanitised so clients can't escape the configured directory.
+		Missing directories are created when the file is first opened.
+
+		A fileSink is kept open per expanded path. Once more than
+		"max_open_files" are open, the least recently used is closed.
+*/
+
+package logwriting
+
+import (
+	"LoggingService/config"
+	"container/list"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Default for "max_open_files" if left out of config.json
+const defaultMaxOpenFiles = 64
+
+// Value substituted into a path when a log doesn't contain the placeholder's field
+const missingFieldValue = "unknown"
+
+type route struct {
+	field   string
+	values  []string       //From "equals" or "in", compared as text
+	matcher *regexp.Regexp //From "regex"
+	path    string
+}
+
+type cachedSink struct {
+	path string
+	sink Sink
+}
+
+type router struct {
+	routes       []route
+	defaultPath  string
+	settings     config.LogfileSettings
+	errorLogPath string
+	maxOpenFiles int
+
+	mutex  sync.Mutex
+	sinks  map[string]*list.Element //Of *cachedSink, keyed by expanded path
+	recent *list.List               //Most recently used sink at the front
+	closed bool
+}
+
+func newRouter(settings config.LogfileSettings, errorLogPath string) *router {
+
+	r := &router{
+		defaultPath:  settings.Path,
+		settings:     settings,
+		errorLogPath: errorLogPath,
+		maxOpenFiles: defaultMaxOpenFiles,
+		sinks:        make(map[string]*list.Element),
+		recent:       list.New(),
+	}
+
+	if settings.MaxOpenFiles > 0 {
+		r.maxOpenFiles = settings.MaxOpenFiles
+	}
+
+	for i := range settings.Routes {
+		routeSettings := &settings.Routes[i]
+		rt := route{field: routeSettings.Field, path: routeSettings.Path}
+		if routeSettings.Matcher != nil {
+			rt.matcher = routeSettings.Matcher
+		} else if routeSettings.In != nil {
+			for _, value := range routeSettings.In {
+				rt.values = append(rt.values, fmt.Sprint(value))
+			}
+		} else {
+			rt.values = []string{fmt.Sprint(routeSettings.Equals)}
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	return r
+}
+
+// Path of the file a log belongs in, with placeholders filled in
+func (r *router) pathFor(log map[string]interface{}) string {
+
+	path := r.defaultPath
+	for _, rt := range r.routes {
+		if rt.matches(log) {
+			path = rt.path
+			break
+		}
+	}
+
+	return config.PathPlaceholder.ReplaceAllStringFunc(path, func(placeholder string) string {
+		value, exists := log[placeholder[1:len(placeholder)-1]]
+		if !exists || value == nil {
+			return missingFieldValue
+		}
+		return sanitisePathSegment(fmt.Sprint(value))
+	})
+}
+
+func (rt *route) matches(log map[string]interface{}) bool {
+
+	value, exists := log[rt.field]
+	if !exists {
+		return false
+	}
+
+	text := fmt.Sprint(value)
+	if rt.matcher != nil {
+		return rt.matcher.MatchString(text)
+	}
+	return slices.Contains(rt.values, text)
+}
+
+// Replaces anything but letters, digits, '.', '-' & '_' so a value can't add
+// directories or climb out of one
+func sanitisePathSegment(value string) string {
+
+	segment := strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+			return char
+		case char == '.', char == '-', char == '_':
+			return char
+		}
+		return '_'
+	}, value)
+
+	if segment == "" || segment == "." || segment == ".." {
+		return "_"
+	}
+	return segment
+}
+
+// Queues entries for the file at path, opening a sink for it if needed
+func (r *router) write(path string, entries ...string) error {
+	for {
+		sink, err := r.sinkFor(path)
+		if err != nil {
+			return err
+		}
+		err = sink.Write(entries...)
+		if !errors.Is(err, errSinkClosed) {
+			return err
+		}
+		//Closed to make room for another file since it was looked up; open it again
+	}
+}
+
+func (r *router) sinkFor(path string) (Sink, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errSinkClosed
+	}
+
+	if element, exists := r.sinks[path]; exists {
+		r.recent.MoveToFront(element)
+		return element.Value.(*cachedSink).sink, nil
+	}
+
+	settings := r.settings
+	settings.Path = path
+	sink := newSink(settings, r.errorLogPath)
+	r.sinks[path] = r.recent.PushFront(&cachedSink{path: path, sink: sink})
+
+	//Close the least recently used files, writing out anything they still hold
+	for r.recent.Len() > r.maxOpenFiles {
+		oldest := r.recent.Remove(r.recent.Back()).(*cachedSink)
+		delete(r.sinks, oldest.path)
+		oldest.sink.Close()
+	}
+
+	return sink, nil
+}
+
+func (r *router) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	for element := r.recent.Front(); element != nil; element = element.Next() {
+		element.Value.(*cachedSink).sink.Close()
+	}
+	r.sinks = make(map[string]*list.Element)
+	r.recent.Init()
+}
@@ -0,0 +1,34 @@
+/*
+* FILE : 			sink.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			A Sink is a destination for formatted log entries. The LogWriter
+		formats each log once per configured sink (each with its own format &
+		column order), then hands the entries to that sink. Where routes or
+		path placeholders are configured, there is a sink per file (see routing.go).
+
+		Implementations:
+		- fileSink (filesink.go): Buffered, asynchronous writes to a file
+*/
+
+package logwriting
+
+import (
+	"LoggingService/config"
+)
+
+type Sink interface {
+	//Writes entries back to back. May return before they reach their destination.
+	Write(entries ...string) error
+
+	//Blocks until everything written so far has reached its destination
+	Flush() error
+
+	//Flushes and releases the sink. No further writes are accepted.
+	Close() error
+}
+
+// Creates the sink described by a single entry in logfile_settings>>sinks
+func newSink(settings config.LogfileSettings, errorLogPath string) Sink {
+	return newFileSink(settings.Path, errorLogPath, settings)
+}
@@ -0,0 +1,260 @@
+/*
+* FILE : 			syslog.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Converts syslog messages into the same map[string]interface{} shape
+		produced by unmarshalling a JSON message, so they can be validated
+		against the incoming_message_schema and formatted by the LogWriter.
+
+		Both RFC 5424 ("<PRI>VERSION TIMESTAMP HOST APP PROCID MSGID [SD] MSG")
+		and RFC 3164 / BSD ("<PRI>Mmm dd hh:mm:ss HOST TAG[PID]: MSG") are
+		accepted; the format is detected from the VERSION following the PRI.
+
+		Fields produced (NILVALUE "-" and missing parts are left out):
+		- priority, facility, severity, version (5424 only)
+		- syslog_timestamp, hostname, app_name, procid, msgid (5424 only)
+		- structured_data (5424 only): { SD-ID: { PARAM-NAME: PARAM-VALUE } }
+		- message
+*/
+
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 5424 placeholder for an empty header field
+const nilValue = "-"
+
+// Optional UTF-8 byte order mark before an RFC 5424 MSG
+const utf8Bom = "\xef\xbb\xbf"
+
+// Largest valid PRI: facility 23, severity 7
+const maxPriority = 191
+
+// Parses an RFC 5424 or RFC 3164 message.
+// Returns an error if the message has no valid PRI, or a malformed RFC 5424 header.
+func Parse(message []byte) (map[string]interface{}, error) {
+
+	//Transports commonly leave a line terminator on the end
+	msg := strings.TrimRight(string(message), "\r\n\x00")
+
+	priority, rest, err := parsePriority(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{
+		"priority": priority,
+		"facility": priority / 8,
+		"severity": priority % 8,
+	}
+
+	if isRfc5424(rest) {
+		err = parseRfc5424(rest, fields)
+		if err != nil {
+			return nil, err
+		}
+		return fields, nil
+	}
+
+	parseRfc3164(rest, fields)
+	return fields, nil
+}
+
+// Reads "<PRI>" off the front of a message
+func parsePriority(msg string) (int, string, error) {
+
+	if len(msg) == 0 || msg[0] != '<' {
+		return 0, "", errors.New("syslog message must begin with <PRI>")
+	}
+
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return 0, "", errors.New("syslog message has an invalid <PRI>")
+	}
+
+	priority, err := strconv.Atoi(msg[1:end])
+	if err != nil || priority < 0 || priority > maxPriority {
+		return 0, "", fmt.Errorf("syslog message has an invalid <PRI>: %q", msg[:end+1])
+	}
+
+	return priority, msg[end+1:], nil
+}
+
+// RFC 5424 headers carry a numeric VERSION directly after the PRI
+func isRfc5424(rest string) bool {
+
+	for i := 0; i < len(rest) && i < 3; i++ {
+		if rest[i] == ' ' {
+			return i > 0
+		}
+		if rest[i] < '0' || rest[i] > '9' {
+			return false
+		}
+	}
+	return false
+}
+
+func parseRfc5424(rest string, fields map[string]interface{}) error {
+
+	//VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := make([]string, 6)
+	for i := range header {
+		token, remaining, found := strings.Cut(rest, " ")
+		if !found || token == "" {
+			return errors.New("syslog message has an incomplete RFC 5424 header")
+		}
+		header[i] = token
+		rest = remaining
+	}
+
+	version, err := strconv.Atoi(header[0])
+	if err != nil {
+		return fmt.Errorf("syslog message has an invalid version: %q", header[0])
+	}
+	fields["version"] = version
+
+	headerFields := []string{"syslog_timestamp", "hostname", "app_name", "procid", "msgid"}
+	for i, name := range headerFields {
+		if header[i+1] != nilValue {
+			fields[name] = header[i+1]
+		}
+	}
+
+	//STRUCTURED-DATA is either NILVALUE or one or more [elements]
+	if strings.HasPrefix(rest, nilValue) {
+		rest = rest[len(nilValue):]
+	} else {
+		structuredData, remaining, err := parseStructuredData(rest)
+		if err != nil {
+			return err
+		}
+		fields["structured_data"] = structuredData
+		rest = remaining
+	}
+
+	//MSG is optional, but must be separated from STRUCTURED-DATA by a space
+	if rest == "" {
+		return nil
+	}
+	if rest[0] != ' ' {
+		return errors.New("syslog message has malformed structured data")
+	}
+	fields["message"] = strings.TrimPrefix(rest[1:], utf8Bom)
+	return nil
+}
+
+// Parses [SD-ID PARAM="VALUE" ...] elements until the first character that isn't '['.
+// Returns the elements and whatever follows them.
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+
+	malformed := errors.New("syslog message has malformed structured data")
+	data := make(map[string]interface{})
+
+	if len(s) == 0 || s[0] != '[' {
+		return nil, "", malformed
+	}
+
+	for len(s) > 0 && s[0] == '[' {
+		s = s[1:]
+
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd <= 0 {
+			return nil, "", malformed
+		}
+		id := s[:idEnd]
+		s = s[idEnd:]
+
+		params := make(map[string]interface{})
+		for len(s) > 0 && s[0] == ' ' {
+			s = s[1:]
+
+			nameEnd := strings.IndexByte(s, '=')
+			if nameEnd <= 0 || nameEnd+1 >= len(s) || s[nameEnd+1] != '"' {
+				return nil, "", malformed
+			}
+			name := s[:nameEnd]
+			s = s[nameEnd+2:]
+
+			//Values are quoted, with '"', '\' and ']' escaped by a backslash
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					value.WriteByte(s[i+1])
+					i++
+					continue
+				}
+				if s[i] == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				}
+				value.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, "", malformed
+			}
+			params[name] = value.String()
+		}
+
+		if len(s) == 0 || s[0] != ']' {
+			return nil, "", malformed
+		}
+		s = s[1:]
+		data[id] = params
+	}
+
+	return data, s, nil
+}
+
+// RFC 3164 is only loosely structured, so every part after the PRI is best-effort.
+// Anything that can't be recognised is left in the message.
+func parseRfc3164(rest string, fields map[string]interface{}) {
+
+	//TIMESTAMP, e.g. "Oct  9 22:33:20", is always followed by HOSTNAME
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			fields["syslog_timestamp"] = rest[:len(time.Stamp)]
+			rest = rest[len(time.Stamp)+1:]
+
+			//Some senders skip HOSTNAME, in which case the TAG comes next
+			token, remaining, found := strings.Cut(rest, " ")
+			if found && token != "" && !strings.HasSuffix(token, ":") && !strings.HasSuffix(token, "]") {
+				fields["hostname"] = token
+				rest = remaining
+			}
+		}
+	}
+
+	//TAG, optionally with "[PID]", terminated by ':'
+	tagEnd := strings.IndexAny(rest, "[: ")
+	if tagEnd > 0 && rest[tagEnd] != ' ' {
+		tag := rest[:tagEnd]
+		remaining := rest[tagEnd:]
+
+		procid := ""
+		if remaining[0] == '[' {
+			pidEnd := strings.IndexByte(remaining, ']')
+			if pidEnd > 1 {
+				procid = remaining[1:pidEnd]
+				remaining = remaining[pidEnd+1:]
+			}
+		}
+
+		if strings.HasPrefix(remaining, ":") {
+			fields["app_name"] = tag
+			if procid != "" {
+				fields["procid"] = procid
+			}
+			rest = strings.TrimPrefix(remaining[1:], " ")
+		}
+	}
+
+	fields["message"] = rest
+}
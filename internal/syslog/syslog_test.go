@@ -0,0 +1,155 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		message string
+		want    map[string]interface{}
+	}{
+		{
+			name:    "rfc5424 NILVALUE header fields are left out",
+			message: "<34>1 2003-10-11T22:14:15.003Z - su - - - 'su root' failed",
+			want: map[string]interface{}{
+				"priority": 34, "facility": 4, "severity": 2, "version": 1,
+				"syslog_timestamp": "2003-10-11T22:14:15.003Z",
+				"app_name":         "su",
+				"message":          "'su root' failed",
+			},
+		},
+		{
+			name:    "rfc5424 all NILVALUE, no message",
+			message: "<165>1 - - - - - -",
+			want: map[string]interface{}{
+				"priority": 165, "facility": 20, "severity": 5, "version": 1,
+			},
+		},
+		{
+			name:    "rfc5424 BOM & line terminator removed",
+			message: "<13>1 - host app 42 ID1 - \xef\xbb\xbfhello\r\n",
+			want: map[string]interface{}{
+				"priority": 13, "facility": 1, "severity": 5, "version": 1,
+				"hostname": "host", "app_name": "app", "procid": "42", "msgid": "ID1",
+				"message": "hello",
+			},
+		},
+		{
+			name:    "rfc5424 structured data escapes",
+			message: `<165>1 - host app - ID47 [ex@1 quote="a\"b" slash="a\\b" bracket="a\]b" other="a\nb"][empty@2] msg`,
+			want: map[string]interface{}{
+				"priority": 165, "facility": 20, "severity": 5, "version": 1,
+				"hostname": "host", "app_name": "app", "msgid": "ID47",
+				"structured_data": map[string]interface{}{
+					"ex@1": map[string]interface{}{
+						"quote":   `a"b`,
+						"slash":   `a\b`,
+						"bracket": `a]b`,
+						"other":   `a\nb`, //Not an escape, so the backslash stays
+					},
+					"empty@2": map[string]interface{}{},
+				},
+				"message": "msg",
+			},
+		},
+		{
+			name:    "rfc5424 structured data without message",
+			message: `<165>1 - - - - - [ex@1 a="b"]`,
+			want: map[string]interface{}{
+				"priority": 165, "facility": 20, "severity": 5, "version": 1,
+				"structured_data": map[string]interface{}{
+					"ex@1": map[string]interface{}{"a": "b"},
+				},
+			},
+		},
+		{
+			name:    "rfc3164 hostname, tag & pid",
+			message: "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed",
+			want: map[string]interface{}{
+				"priority": 34, "facility": 4, "severity": 2,
+				"syslog_timestamp": "Oct 11 22:14:15",
+				"hostname":         "mymachine", "app_name": "su", "procid": "123",
+				"message": "'su root' failed",
+			},
+		},
+		{
+			name:    "rfc3164 space-padded day",
+			message: "<13>Oct  9 22:33:20 host cron: job done",
+			want: map[string]interface{}{
+				"priority": 13, "facility": 1, "severity": 5,
+				"syslog_timestamp": "Oct  9 22:33:20",
+				"hostname":         "host", "app_name": "cron",
+				"message": "job done",
+			},
+		},
+		{
+			name:    "rfc3164 tag & pid without hostname",
+			message: "<13>Oct 11 22:14:15 sshd[42]: Accepted publickey",
+			want: map[string]interface{}{
+				"priority": 13, "facility": 1, "severity": 5,
+				"syslog_timestamp": "Oct 11 22:14:15",
+				"app_name":         "sshd", "procid": "42",
+				"message": "Accepted publickey",
+			},
+		},
+		{
+			name:    "rfc3164 tag without hostname",
+			message: "<13>Oct 11 22:14:15 cron: job done",
+			want: map[string]interface{}{
+				"priority": 13, "facility": 1, "severity": 5,
+				"syslog_timestamp": "Oct 11 22:14:15",
+				"app_name":         "cron",
+				"message":          "job done",
+			},
+		},
+		{
+			name:    "rfc3164 no timestamp or tag",
+			message: "<13>just a message",
+			want: map[string]interface{}{
+				"priority": 13, "facility": 1, "severity": 5,
+				"message": "just a message",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse([]byte(test.message))
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %s", test.message, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q)\n got: %v\nwant: %v", test.message, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"no PRI", "Oct 11 22:14:15 host app: msg"},
+		{"PRI out of range", "<192>1 - - - - - -"},
+		{"PRI not a number", "<ab>1 - - - - - -"},
+		{"rfc5424 incomplete header", "<13>1 - host app"},
+		{"rfc5424 unclosed structured data", `<13>1 - - - - - [ex@1 a="b"`},
+		{"rfc5424 unterminated param value", `<13>1 - - - - - [ex@1 a="b]`},
+		{"rfc5424 unquoted param value", `<13>1 - - - - - [ex@1 a=b]`},
+		{"rfc5424 message not separated from structured data", `<13>1 - - - - - [ex@1]msg`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := Parse([]byte(test.message)); err == nil {
+				t.Errorf("Parse(%q) = %v, want an error", test.message, got)
+			}
+		})
+	}
+}
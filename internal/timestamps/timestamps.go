@@ -0,0 +1,228 @@
+/*
+* FILE : 			timestamps.go
+* FIRST VERSION : 	2026-10-16
+* DESCRIPTION :
+			Resolves "timestamp_format" & "timezone" from logfile_settings into
+		a Format, used to stamp each log.
+
+		"timestamp_format" may be any of:
+		- A layout name: 		"RFC3339", "Kitchen", "DateTime", etc (see Named)
+		- An epoch unit: 		"unix" (seconds), "unix_ms" or "unix_ns". Written as numbers.
+		- A strftime pattern: 	Anything containing '%', e.g. "%Y-%m-%d %H:%M:%S"
+		- A Go layout: 			Anything else, e.g. "2006-01-02 15:04:05.000"
+
+		"timezone" is an IANA name ("Europe/London"), "UTC", or "Local" (default).
+
+		Layouts without a date (e.g. "Kitchen") are rejected unless allowed,
+		as timestamps from different days can't be told apart.
+
+		The same Format can read times back with Parse(), e.g. event times sent
+		by clients. Layouts without a zone are read in "timezone".
+*/
+
+package timestamps
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" //Time zones still resolve on hosts without a zoneinfo database
+)
+
+// Named layouts accepted by "timestamp_format"
+var Named = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+	"StampMicro":  time.StampMicro,
+	"StampNano":   time.StampNano,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+}
+
+// Used when "timestamp_format" is left out
+const DefaultLayout = time.RFC3339
+
+// Epoch unit strings to be converted to int
+type epochUnit int
+
+const (
+	NotEpoch epochUnit = iota
+	EpochSeconds
+	EpochMillis
+	EpochNanos
+)
+
+var epochUnits = map[string]epochUnit{
+	"unix":    EpochSeconds,
+	"unix_ms": EpochMillis,
+	"unix_ns": EpochNanos,
+}
+
+// strftime directives & their Go layout equivalents
+var strftimeDirectives = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'b': "Jan", 'h': "Jan", 'B': "January",
+	'd': "02", 'e': "_2", 'j': "002", 'a': "Mon", 'A': "Monday",
+	'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM",
+	'L': "000", 'f': "000000", 'N': "000000000",
+	'z': "-0700", 'Z': "MST",
+	'F': "2006-01-02", 'T': "15:04:05", 'D': "01/02/06", 'R': "15:04",
+	'n': "\n", 't': "\t", '%': "%",
+}
+
+var ErrNoDate = errors.New("layout has no date component")
+
+// How timestamps are written for one logfile
+type Format struct {
+	layout   string
+	epoch    epochUnit
+	location *time.Location
+}
+
+// Resolves a timestamp_format & timezone. Returns ErrNoDate (wrapped) for layouts
+// lacking a date, unless allowDateless is set.
+func New(timestampFormat string, timezone string, allowDateless bool) (Format, error) {
+
+	var format Format
+
+	switch timezone {
+	case "", "Local":
+		format.location = time.Local
+	default:
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return Format{}, err
+		}
+		format.location = location
+	}
+
+	if unit, exists := epochUnits[timestampFormat]; exists {
+		format.epoch = unit
+		return format, nil
+	}
+
+	layout, err := resolveLayout(timestampFormat)
+	if err != nil {
+		return Format{}, err
+	}
+	format.layout = layout
+
+	if !allowDateless && !hasDate(layout) {
+		return Format{}, fmt.Errorf("%q: %w", timestampFormat, ErrNoDate)
+	}
+	return format, nil
+}
+
+// Go layout for a layout name, strftime pattern or Go layout
+func resolveLayout(timestampFormat string) (string, error) {
+
+	if timestampFormat == "" {
+		return DefaultLayout, nil
+	}
+	if layout, exists := Named[timestampFormat]; exists {
+		return layout, nil
+	}
+	if strings.Contains(timestampFormat, "%") {
+		return fromStrftime(timestampFormat)
+	}
+
+	//A Go layout with no elements in it is almost certainly a mistake, e.g. "YYYY-MM-DD"
+	reference := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	if reference.Format(timestampFormat) == timestampFormat {
+		return "", fmt.Errorf("%q is not a layout name, strftime pattern or Go layout", timestampFormat)
+	}
+	return timestampFormat, nil
+}
+
+func fromStrftime(pattern string) (string, error) {
+
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			sb.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return "", fmt.Errorf("strftime pattern %q ends with a lone '%%'", pattern)
+		}
+		i++
+		layout, exists := strftimeDirectives[pattern[i]]
+		if !exists {
+			return "", fmt.Errorf("strftime pattern %q contains unsupported directive %%%c", pattern, pattern[i])
+		}
+		sb.WriteString(layout)
+	}
+	return sb.String(), nil
+}
+
+// Whether a layout tells days apart: two times a week apart, on the same weekday
+// at the same time of day, must format differently
+func hasDate(layout string) bool {
+	day := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	return day.Format(layout) != day.AddDate(0, 0, 7).Format(layout)
+}
+
+// The timestamp to write for t: a string, or an int64 for epoch formats
+func (f Format) Value(t time.Time) interface{} {
+	switch f.epoch {
+	case EpochSeconds:
+		return t.Unix()
+	case EpochMillis:
+		return t.UnixMilli()
+	case EpochNanos:
+		return t.UnixNano()
+	}
+	return t.In(f.location).Format(f.layout)
+}
+
+// Reads a time written in this format. Epoch formats accept a JSON number or a string of digits.
+func (f Format) Parse(value interface{}) (time.Time, error) {
+
+	if f.epoch != NotEpoch {
+		var epoch int64
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return time.Time{}, fmt.Errorf("epoch time %v is not a whole number", v)
+			}
+			epoch = int64(v)
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("epoch time %q is not a whole number", v)
+			}
+			epoch = parsed
+		default:
+			return time.Time{}, fmt.Errorf("epoch time must be a number, got %T", value)
+		}
+
+		switch f.epoch {
+		case EpochSeconds:
+			return time.Unix(epoch, 0), nil
+		case EpochMillis:
+			return time.UnixMilli(epoch), nil
+		default:
+			return time.Unix(0, epoch), nil
+		}
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("time must be a string, got %T", value)
+	}
+	return time.ParseInLocation(f.layout, text, f.location)
+}